@@ -2,11 +2,13 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -30,75 +32,162 @@ var (
 
 	repoCreation = flag.Bool("repo_creation",
 		true,
-		"Whether /v1/createrepo is enabled. Can be flipped quickly to limit abuse, should it happen.")
+		"Whether /v1/createrepo is enabled. Can be flipped quickly (in the config file, followed by SIGHUP) to limit abuse, should it happen.")
 )
 
-const group = "go-team/packages"
-
 var salsa = salsaClient()
 
 func salsaClient() *gitlab.Client {
-	cl := gitlab.NewClient(nil, os.Getenv("SALSA_TOKEN"))
+	hc := &http.Client{Transport: &salsaTransport{rt: http.DefaultTransport}}
+	cl := gitlab.NewClient(hc, os.Getenv("SALSA_TOKEN"))
 	cl.SetBaseURL("https://salsa.debian.org/api/v4")
 	return cl
 }
 
-var rateLimit = make(chan struct{})
+var protection = defaultProtectionPolicy
 
 // internalServerError returns a non-nil error from handler as a HTTP 500 error.
 func internalServerError(handler func(http.ResponseWriter, *http.Request) error) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if err := handler(w, r); err != nil {
+			logf(r.Context(), "%s: %v", r.URL.Path, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
 }
 
+// clientAddr returns the address of the client which sent r, taking into
+// account X-Forwarded-For headers set by our frontend webserver.
+func clientAddr(r *http.Request) string {
+	src := r.Header.Get("X-Forwarded-For")
+	if src == "" || !activeConfig().trustedProxy(r) {
+		src = r.RemoteAddr
+	}
+	return src
+}
+
+// repoRequest validates a request to modify a repository: it must be an
+// authenticated POST request specifying a repo (without slashes) and
+// optionally one of the configured groups. If the request is invalid, an error
+// is returned to the client and ok is false.
+func repoRequest(w http.ResponseWriter, r *http.Request) (user string, g *groupConfig, name string, ok bool) {
+	if r.Method != "POST" {
+		http.Error(w, "this URL requires HTTP POST", http.StatusMethodNotAllowed)
+		return "", nil, "", false
+	}
+
+	cfg := activeConfig()
+	user, ok = cfg.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pgt-api-server"`)
+		http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+		return "", nil, "", false
+	}
+
+	g, err := cfg.group(r.FormValue("group"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, "", false
+	}
+
+	name = r.FormValue("repo")
+	if name == "" {
+		http.Error(w, `no "repo" parameter found`, http.StatusBadRequest)
+		return "", nil, "", false
+	}
+	name = path.Clean(name)
+	if strings.Contains(name, "/") {
+		http.Error(w, `repo must not contain slashes`, http.StatusBadRequest)
+		return "", nil, "", false
+	}
+	return user, g, name, true
+}
+
 // TODO: misnomer: rename or make an actual apache log
 func apacheLog(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		src := r.Header.Get("X-Forwarded-For")
-		if src == "" ||
-			(!strings.HasPrefix(r.RemoteAddr, "[::1]:") &&
-				!strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") &&
-				!strings.HasPrefix(r.RemoteAddr, "172.17.")) {
-			src = r.RemoteAddr
-		}
-
 		start := time.Now()
 		h.ServeHTTP(w, r)
-		log.Printf("%s %s %s: %v", src, r.Method, r.URL, time.Since(start))
+		logf(r.Context(), "%s %s %s: %v", clientAddr(r), r.Method, r.URL, time.Since(start))
 	})
 }
 
+// handle registers handler for pattern, wrapped in the middleware all API
+// handlers share.
+func handle(pattern string, handler func(http.ResponseWriter, *http.Request) error) {
+	http.Handle(pattern, withRequestID(apacheLog(traced(pattern, internalServerError(handler)))))
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
 
-	go func() {
-		for range time.Tick(1 * time.Second) {
-			rateLimit <- struct{}{}
-		}
-	}()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *checkConfig {
+		log.Printf("configuration OK")
+		return
+	}
+	applyConfig(cfg)
+	if *configPath != "" {
+		go reloadOnSIGHUP()
+	}
+
+	protection, err = loadProtectionPolicy(*protectionPolicyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := openAuditLog(); err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// TODO: prometheus metrics
 
+	handle("/v1/createrepo", createRepo)
+	handle("/v1/configrepo", configRepo)
+	handle("/v1/transferrepo", transferRepo)
+	handle("/v1/archiverepo", archiveRepo)
+	handle("/v1/repos", repos)
+
+	if cfg.TLS.Mode == "none" {
+		log.Printf("listening on %s", cfg.Listen)
+		log.Print(http.ListenAndServe(cfg.Listen, nil))
+		return
+	}
+
 	m := &autocert.Manager{
-		Cache:      autocert.DirCache(*certCacheDir),
+		Cache:      autocert.DirCache(cfg.TLS.CertCacheDir),
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist("pgt-api-server.debian.net"),
+		HostPolicy: autocert.HostWhitelist(cfg.TLS.Hostname),
+	}
+	go func() { log.Fatal(http.ListenAndServe(cfg.ListenChallenge, m.HTTPHandler(nil))) }()
+
+	if cfg.TLS.Mode == "autocert" {
+		srv := &http.Server{
+			Addr:      cfg.Listen,
+			TLSConfig: m.TLSConfig(),
+		}
+		log.Printf("listening on %s (TLS)", cfg.Listen)
+		log.Print(srv.ListenAndServeTLS("", ""))
+		return
 	}
-	go func() { log.Fatal(http.ListenAndServe(*listenChallenge, m.HTTPHandler(nil))) }()
 
 	// Trigger certificate creation so that we can use the cached certificate in
 	// the frontend webserver.
-	_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "pgt-api-server.debian.net"})
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: cfg.TLS.Hostname})
 	if err != nil {
 		log.Fatalf("GetCertificate: %v", err)
 	}
 
-	http.Handle("/v1/createrepo", apacheLog(internalServerError(createRepo)))
-	http.Handle("/v1/configrepo", apacheLog(internalServerError(configRepo)))
-	log.Printf("listening on %s", *listen)
-	http.ListenAndServe(*listen, nil)
+	log.Printf("listening on %s", cfg.Listen)
+	log.Print(http.ListenAndServe(cfg.Listen, nil))
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// archiveRepo archives the specified repo underneath the group (default
+// go-team/packages), e.g. once the package was removed from Debian.
+func archiveRepo(w http.ResponseWriter, r *http.Request) error {
+	user, g, name, ok := repoRequest(w, r)
+	if !ok {
+		return nil
+	}
+	repo := path.Join(g.Path, name)
+
+	audit(r, user, "archiverepo", repo)
+
+	ctx := r.Context()
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	var p *gitlab.Project
+	err := traceOp(ctx, "ArchiveProject", func(ctx context.Context) error {
+		var err error
+		p, _, err = salsa.Projects.ArchiveProject(repo, gitlab.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ArchiveProject(%q): %v", repo, err)
+	}
+	activeConfig().notifier.notify(event{Kind: eventArchive, Repo: repo, URL: p.WebURL, RequestID: requestID(ctx)})
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	configPath = flag.String("config",
+		"",
+		"Path to a JSON configuration file. Settings which are present in the file take precedence over flags. The file is re-read on SIGHUP.")
+
+	checkConfig = flag.Bool("check_config",
+		false,
+		"Validate the configuration file and exit")
+)
+
+// duration is a time.Duration which (un)marshals as a string, e.g. "1s".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// tlsConfig configures how pgt-api-server obtains and uses its certificate.
+type tlsConfig struct {
+	// Mode is one of:
+	//
+	//	frontend   obtain a certificate via ACME for use by the frontend
+	//	           webserver, serve plain HTTP on Listen
+	//	autocert   obtain a certificate via ACME and serve HTTPS on Listen
+	//	none       do not use ACME, serve plain HTTP on Listen
+	Mode         string `json:"mode"`
+	Hostname     string `json:"hostname"`
+	CertCacheDir string `json:"cert_cache_dir"`
+}
+
+// groupConfig describes a salsa group in which repositories can be managed.
+type groupConfig struct {
+	Path        string `json:"path"`
+	NamespaceID int    `json:"namespace_id"`
+}
+
+type rateLimitConfig struct {
+	// Interval is the minimum duration between two requests which modify
+	// repositories, once Burst requests have been used up.
+	Interval duration `json:"interval"`
+	Burst    int      `json:"burst"`
+}
+
+type authConfig struct {
+	// Tokens maps user names to the hex-encoded SHA-256 hash of their bearer
+	// token. Requests which modify repositories require a valid token unless
+	// Tokens is empty.
+	Tokens map[string]string `json:"tokens"`
+}
+
+// retryConfig configures how often delivery to a notification sink is
+// attempted. The backoff doubles after each failed attempt.
+type retryConfig struct {
+	Attempts int      `json:"attempts"`
+	Backoff  duration `json:"backoff"`
+}
+
+type smtpSinkConfig struct {
+	Addr            string   `json:"addr"`
+	From            string   `json:"from"`
+	To              []string `json:"to"`
+	SubjectTemplate string   `json:"subject_template"` // defaults to defaultSMTPSubject
+	BodyTemplate    string   `json:"body_template"`    // defaults to defaultSMTPBody
+	retryConfig
+}
+
+type webhookSinkConfig struct {
+	URL          string `json:"url"`
+	BodyTemplate string `json:"body_template"` // defaults to defaultWebhookBody
+	retryConfig
+}
+
+type chatSinkConfig struct {
+	URL             string `json:"url"`
+	Username        string `json:"username"`
+	MessageTemplate string `json:"message_template"` // defaults to defaultChatMessage
+	retryConfig
+}
+
+type notifyConfig struct {
+	SMTP     []smtpSinkConfig    `json:"smtp"`
+	Webhooks []webhookSinkConfig `json:"webhooks"`
+	Chat     []chatSinkConfig    `json:"chat"`
+}
+
+// serverConfig is the complete configuration of pgt-api-server. All settings
+// except for Listen, ListenChallenge and TLS are applied on SIGHUP.
+type serverConfig struct {
+	Listen          string          `json:"listen"`
+	ListenChallenge string          `json:"listen_challenge"`
+	TLS             tlsConfig       `json:"tls"`
+	Groups          []groupConfig   `json:"groups"` // the first group is the default
+	RepoCreation    bool            `json:"repo_creation"`
+	RateLimit       rateLimitConfig `json:"rate_limit"`
+	Auth            authConfig      `json:"auth"`
+	Notify          notifyConfig    `json:"notify"`
+
+	// TrustedProxies lists the networks (in CIDR notation) of frontend
+	// webservers whose X-Forwarded-For header is trusted.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// derived by validate:
+	trustedProxies []*net.IPNet
+	notifier       *notifier
+}
+
+// flagConfig returns the configuration resulting from flags alone.
+func flagConfig() *serverConfig {
+	cfg := &serverConfig{
+		Listen:          *listen,
+		ListenChallenge: *listenChallenge,
+		TLS: tlsConfig{
+			Mode:         "frontend",
+			Hostname:     "pgt-api-server.debian.net",
+			CertCacheDir: *certCacheDir,
+		},
+		Groups: []groupConfig{
+			{Path: "go-team/packages", NamespaceID: 2638},
+		},
+		RepoCreation: *repoCreation,
+		RateLimit: rateLimitConfig{
+			Interval: duration{1 * time.Second},
+			Burst:    1,
+		},
+		TrustedProxies: []string{
+			"::1/128",
+			"127.0.0.0/8",
+			"172.17.0.0/16", // docker
+		},
+	}
+	if *notifySMTP != "" {
+		cfg.Notify.SMTP = append(cfg.Notify.SMTP, smtpSinkConfig{
+			Addr: *notifySMTP,
+			From: *notifySMTPFrom,
+			To:   strings.Split(*notifySMTPTo, ","),
+			// Mailing list delivery is not time-critical, but mail servers
+			// might be down for a little while:
+			retryConfig: retryConfig{Attempts: 5, Backoff: duration{30 * time.Second}},
+		})
+	}
+	if *notifyWebhook != "" {
+		cfg.Notify.Webhooks = append(cfg.Notify.Webhooks, webhookSinkConfig{
+			URL:         *notifyWebhook,
+			retryConfig: retryConfig{Attempts: 3, Backoff: duration{5 * time.Second}},
+		})
+	}
+	if *notifyChatWebhook != "" {
+		cfg.Notify.Chat = append(cfg.Notify.Chat, chatSinkConfig{
+			URL:      *notifyChatWebhook,
+			Username: "pgt-api-server",
+			// Chat messages are only useful while they are current:
+			retryConfig: retryConfig{Attempts: 2, Backoff: duration{1 * time.Second}},
+		})
+	}
+	return cfg
+}
+
+// loadConfig reads the configuration file at path (if non-empty) on top of the
+// flag configuration and validates the result.
+func loadConfig(path string) (*serverConfig, error) {
+	cfg := flagConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *serverConfig) validate() error {
+	if cfg.Listen == "" {
+		return fmt.Errorf("listen must not be empty")
+	}
+	switch cfg.TLS.Mode {
+	case "frontend", "autocert":
+		if cfg.ListenChallenge == "" {
+			return fmt.Errorf("listen_challenge must not be empty in TLS mode %q", cfg.TLS.Mode)
+		}
+		if cfg.TLS.Hostname == "" || cfg.TLS.CertCacheDir == "" {
+			return fmt.Errorf("tls.hostname and tls.cert_cache_dir must not be empty in TLS mode %q", cfg.TLS.Mode)
+		}
+	case "none":
+	default:
+		return fmt.Errorf("unknown tls.mode %q: expected frontend, autocert or none", cfg.TLS.Mode)
+	}
+
+	if len(cfg.Groups) == 0 {
+		return fmt.Errorf("at least one group must be configured")
+	}
+	for _, g := range cfg.Groups {
+		if g.Path == "" || g.NamespaceID == 0 {
+			return fmt.Errorf("group %+v: path and namespace_id must be set", g)
+		}
+	}
+
+	if cfg.RateLimit.Interval.Duration <= 0 || cfg.RateLimit.Burst < 1 {
+		return fmt.Errorf("rate_limit: interval must be positive and burst at least 1")
+	}
+
+	for user, hash := range cfg.Auth.Tokens {
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("auth.tokens[%q]: not a hex-encoded SHA-256 hash", user)
+		}
+	}
+
+	cfg.trustedProxies = nil
+	for _, cidr := range cfg.TrustedProxies {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("trusted_proxies: %v", err)
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, ipnet)
+	}
+
+	n, err := newNotifier(&cfg.Notify)
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	cfg.notifier = n
+	return nil
+}
+
+// group returns the configured group with the specified path, or the default
+// group if path is empty.
+func (cfg *serverConfig) group(path string) (*groupConfig, error) {
+	if path == "" {
+		return &cfg.Groups[0], nil
+	}
+	for idx := range cfg.Groups {
+		if cfg.Groups[idx].Path == path {
+			return &cfg.Groups[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("group %q is not configured", path)
+}
+
+// trustedProxy returns whether the request was sent by one of our frontend
+// webservers, i.e. whether its X-Forwarded-For header can be trusted.
+func (cfg *serverConfig) trustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range cfg.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the user name for the bearer token of r. If no tokens
+// are configured, it returns "anonymous".
+func (cfg *serverConfig) authenticate(r *http.Request) (string, bool) {
+	if len(cfg.Auth.Tokens) == 0 {
+		return "anonymous", true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(token))
+	got := hex.EncodeToString(sum[:])
+	for user, want := range cfg.Auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(strings.ToLower(want))) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+var currentConfig atomic.Value // *serverConfig
+
+// activeConfig returns the currently active configuration.
+func activeConfig() *serverConfig {
+	return currentConfig.Load().(*serverConfig)
+}
+
+// limiter limits the rate of requests which modify repositories, so as to
+// limit the damage should pgt-api-server be abused.
+var limiter = rate.NewLimiter(rate.Every(1*time.Second), 1)
+
+// applyConfig makes cfg the active configuration.
+func applyConfig(cfg *serverConfig) {
+	limiter.SetLimit(rate.Every(cfg.RateLimit.Interval.Duration))
+	limiter.SetBurst(cfg.RateLimit.Burst)
+	currentConfig.Store(cfg)
+}
+
+// reloadConfig re-reads the configuration file and applies all settings which
+// can be changed without a restart.
+func reloadConfig() {
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Printf("reloading config failed, keeping previous config: %v", err)
+		return
+	}
+	old := activeConfig()
+	if cfg.Listen != old.Listen ||
+		cfg.ListenChallenge != old.ListenChallenge ||
+		!reflect.DeepEqual(cfg.TLS, old.TLS) {
+		log.Printf("reloading config: changes to listen, listen_challenge or tls require a restart, keeping previous values")
+		cfg.Listen = old.Listen
+		cfg.ListenChallenge = old.ListenChallenge
+		cfg.TLS = old.TLS
+	}
+	applyConfig(cfg)
+	log.Printf("reloaded config from %s", *configPath)
+}
+
+// reloadOnSIGHUP calls reloadConfig whenever the process receives SIGHUP.
+func reloadOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		reloadConfig()
+	}
+}
@@ -1,42 +1,75 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"path"
-	"strings"
 
 	"salsa.debian.org/go-team/ci/config"
+
+	gitlab "github.com/xanzy/go-gitlab"
 )
 
-// configRepo configures the specified repo underneath go-team/packages with
-// go-team-wide settings (CI, webhooks, etc.).
+// configRepo configures the specified repo underneath the group (default
+// go-team/packages) with go-team-wide settings (CI, webhooks, etc.). Its
+// branches and tags are protected as per -protection_policy.
 func configRepo(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != "POST" {
-		http.Error(w, "this URL requires HTTP POST", http.StatusMethodNotAllowed)
+	user, g, name, ok := repoRequest(w, r)
+	if !ok {
 		return nil
 	}
+	repo := path.Join(g.Path, name)
 
-	// TODO: move the repo extraction into common middleware
-	repo := r.FormValue("repo")
-	if repo == "" {
-		http.Error(w, `no "repo" parameter found`, http.StatusBadRequest)
-		return nil
-	}
-	repo = path.Clean(repo)
-	if strings.Contains(repo, "/") {
-		http.Error(w, `repo must not contain slashes`, http.StatusBadRequest)
-		return nil
+	audit(r, user, "configrepo", repo)
+
+	ctx := r.Context()
+	if err := limiter.Wait(ctx); err != nil {
+		return err
 	}
-	repo = path.Join(group, repo)
 
-	// TODO: log repo names in an auditlog
+	var p *gitlab.Project
+	err := traceOp(ctx, "GetProject", func(ctx context.Context) error {
+		var err error
+		p, _, err = salsa.Projects.GetProject(repo, gitlab.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	<-rateLimit
+	return configure(ctx, w, repo, p)
+}
 
-	p, _, err := salsa.Projects.GetProject(repo)
+// configure applies go-team-wide settings and the branch/tag protection policy
+// to p, notifying the team should this fail. Changed protection rules are
+// reported in the response body.
+func configure(ctx context.Context, w http.ResponseWriter, repo string, p *gitlab.Project) error {
+	// config.All accepts neither a context nor a client, so its requests to
+	// salsa carry neither request ID nor trace context; its span covers them
+	// as a whole.
+	err := traceOp(ctx, "config.All", func(context.Context) error { return config.All(p) })
 	if err != nil {
+		activeConfig().notifier.notify(event{Kind: eventConfigFailure, Repo: repo, URL: p.WebURL, Error: err.Error(), RequestID: requestID(ctx)})
 		return err
 	}
 
-	return config.All(p)
+	var changes []string
+	err = traceOp(ctx, "applyProtection", func(ctx context.Context) error {
+		var err error
+		changes, err = applyProtection(&salsaForge{ctx: ctx, cl: salsa}, p.ID, protection)
+		return err
+	})
+	for _, change := range changes {
+		logf(ctx, "%s: protection: %s", repo, change)
+	}
+	if err != nil {
+		err = fmt.Errorf("applying protection policy: %v", err)
+		activeConfig().notifier.notify(event{Kind: eventConfigFailure, Repo: repo, URL: p.WebURL, Error: err.Error(), RequestID: requestID(ctx)})
+		return err
+	}
+	for _, change := range changes {
+		fmt.Fprintf(w, "protection: %s\n", change)
+	}
+	return nil
 }
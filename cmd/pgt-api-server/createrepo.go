@@ -1,57 +1,51 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"path"
-	"strings"
-
-	"salsa.debian.org/go-team/ci/config"
 
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
-// createRepo creates a new repository underneath go-team/packages on
-// salsa.debian.org.
+// createRepo creates a new repository underneath the group (default
+// go-team/packages) on salsa.debian.org.
 func createRepo(w http.ResponseWriter, r *http.Request) error {
-	if !*repoCreation {
+	if !activeConfig().RepoCreation {
 		http.Error(w, "repository creation is disabled by the administrator; please see the mailing list", http.StatusForbidden)
 		return nil
 	}
 
-	if r.Method != "POST" {
-		http.Error(w, "this URL requires HTTP POST", http.StatusMethodNotAllowed)
+	user, g, name, ok := repoRequest(w, r)
+	if !ok {
 		return nil
 	}
+	repo := path.Join(g.Path, name)
 
-	// TODO: move the repo extraction into common middleware
-	repo := r.FormValue("repo")
-	if repo == "" {
-		http.Error(w, `no "repo" parameter found`, http.StatusBadRequest)
-		return nil
-	}
-	repo = path.Clean(repo)
-	if strings.Contains(repo, "/") {
-		http.Error(w, `repo must not contain slashes`, http.StatusBadRequest)
-		return nil
-	}
-	name := repo
-	repo = path.Join(group, repo)
-
-	// TODO: log repo names in an auditlog
+	audit(r, user, "createrepo", repo)
 
-	<-rateLimit
+	ctx := r.Context()
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
 
 	options := &gitlab.CreateProjectOptions{
 		Path:        gitlab.String(name),
-		NamespaceID: gitlab.Int(2638),
+		NamespaceID: gitlab.Int(g.NamespaceID),
 		Description: gitlab.String(fmt.Sprintf("Debian packaging for %s", name)),
 		Visibility:  gitlab.Visibility(gitlab.PublicVisibility),
 	}
-	p, _, err := salsa.Projects.CreateProject(options)
+	var p *gitlab.Project
+	err := traceOp(ctx, "CreateProject", func(ctx context.Context) error {
+		var err error
+		p, _, err = salsa.Projects.CreateProject(options, gitlab.WithContext(ctx))
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("CreateProject(%q): %v", *options.Path, err)
 	}
+	activeConfig().notifier.notify(event{Kind: eventCreate, Repo: repo, URL: p.WebURL, RequestID: requestID(ctx)})
 
-	return config.All(p)
+	return configure(ctx, w, repo, p)
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pault.ag/go/debian/control"
+
+	gitlab "github.com/xanzy/go-gitlab"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	inventoryTTL = flag.Duration("inventory_ttl",
+		1*time.Hour,
+		"How long to cache the /v1/repos inventory before re-fetching debian/control from all repositories")
+
+	inventoryMinRefresh = flag.Duration("inventory_min_refresh",
+		1*time.Minute,
+		"Minimum age of the cached /v1/repos inventory for refresh=1 to re-fetch it, as each re-fetch costs one request per repository on salsa")
+)
+
+// controlSource contains the fields of a debian/control source paragraph which
+// the inventory reports.
+type controlSource struct {
+	Source           string
+	Maintainer       string
+	Uploaders        string
+	GoImportPath     string `control:"XS-Go-Import-Path"`
+	VcsGit           string `control:"Vcs-Git"`
+	StandardsVersion string `control:"Standards-Version"`
+}
+
+// repoInfo is one entry of the inventory.
+type repoInfo struct {
+	Repo             string   `json:"repo"`
+	URL              string   `json:"url"`
+	DefaultBranch    string   `json:"default_branch"`
+	Source           string   `json:"source"`
+	Maintainer       string   `json:"maintainer"`
+	Uploaders        []string `json:"uploaders"`
+	GoImportPath     string   `json:"go_import_path"`
+	VcsGit           string   `json:"vcs_git"`
+	StandardsVersion string   `json:"standards_version"`
+
+	// Error describes why debian/control could not be read or parsed, if
+	// applicable.
+	Error string `json:"error,omitempty"`
+}
+
+// inventoryFields maps the field names which can be used for filtering (and
+// which are used as CSV header) to their value.
+var inventoryFields = []struct {
+	name  string
+	value func(*repoInfo) string
+}{
+	{"repo", func(ri *repoInfo) string { return ri.Repo }},
+	{"url", func(ri *repoInfo) string { return ri.URL }},
+	{"default_branch", func(ri *repoInfo) string { return ri.DefaultBranch }},
+	{"source", func(ri *repoInfo) string { return ri.Source }},
+	{"maintainer", func(ri *repoInfo) string { return ri.Maintainer }},
+	{"uploaders", func(ri *repoInfo) string { return strings.Join(ri.Uploaders, ", ") }},
+	{"go_import_path", func(ri *repoInfo) string { return ri.GoImportPath }},
+	{"vcs_git", func(ri *repoInfo) string { return ri.VcsGit }},
+	{"standards_version", func(ri *repoInfo) string { return ri.StandardsVersion }},
+	{"error", func(ri *repoInfo) string { return ri.Error }},
+}
+
+func inventoryField(name string) (func(*repoInfo) string, bool) {
+	for _, f := range inventoryFields {
+		if f.name == name {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+// inventory caches the repoInfo of all repositories in the configured groups.
+type inventory struct {
+	mu      sync.Mutex
+	repos   []*repoInfo
+	fetched time.Time
+
+	fetches singleflight.Group // at most one fetch runs at a time
+}
+
+var repoInventory = &inventory{}
+
+// get returns the cached inventory. If it is older than *inventoryTTL, the
+// stale inventory is returned while it is re-fetched in the background. If
+// refresh is true (or nothing is cached yet), get waits for the re-fetch,
+// unless the inventory is younger than *inventoryMinRefresh.
+func (inv *inventory) get(ctx context.Context, refresh bool) ([]*repoInfo, time.Time, error) {
+	inv.mu.Lock()
+	repos, fetched := inv.repos, inv.fetched
+	inv.mu.Unlock()
+	if repos != nil {
+		age := time.Since(fetched)
+		if age < *inventoryMinRefresh || !refresh && age < *inventoryTTL {
+			return repos, fetched, nil
+		}
+		if !refresh {
+			inv.fetch(ctx)
+			return repos, fetched, nil
+		}
+	}
+	select {
+	case res := <-inv.fetch(ctx):
+		if res.Err != nil {
+			return nil, time.Time{}, res.Err
+		}
+		inv.mu.Lock()
+		defer inv.mu.Unlock()
+		return inv.repos, inv.fetched, nil
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+}
+
+// fetch re-fetches the inventory, unless a fetch is already running. The fetch
+// is not canceled along with ctx (e.g. when the client which triggered it
+// disconnects), as other requests might be waiting for it. Its result is only
+// cached if it completed.
+func (inv *inventory) fetch(ctx context.Context) <-chan singleflight.Result {
+	ctx = context.WithoutCancel(ctx)
+	return inv.fetches.DoChan("inventory", func() (interface{}, error) {
+		start := time.Now()
+		var repos []*repoInfo
+		err := traceOp(ctx, "fetchInventory", func(ctx context.Context) error {
+			var err error
+			repos, err = fetchInventory(ctx)
+			return err
+		})
+		if err != nil {
+			logf(ctx, "fetching inventory: %v", err)
+			return nil, err
+		}
+		logf(ctx, "fetched inventory of %d repos in %v", len(repos), time.Since(start))
+		inv.mu.Lock()
+		defer inv.mu.Unlock()
+		inv.repos = repos
+		inv.fetched = start
+		return repos, nil
+	})
+}
+
+func fetchInventory(ctx context.Context) ([]*repoInfo, error) {
+	var projects []*gitlab.Project
+	for _, g := range activeConfig().Groups {
+		opt := &gitlab.ListGroupProjectsOptions{
+			ListOptions: gitlab.ListOptions{PerPage: 100},
+			Archived:    gitlab.Bool(false),
+		}
+		for {
+			ps, resp, err := salsa.Groups.ListGroupProjects(g.Path, opt, gitlab.WithContext(ctx))
+			if err != nil {
+				return nil, fmt.Errorf("ListGroupProjects(%q): %v", g.Path, err)
+			}
+			projects = append(projects, ps...)
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+
+	repos := make([]*repoInfo, len(projects))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, 10) // be gentle to salsa
+	for idx, p := range projects {
+		wg.Add(1)
+		go func(idx int, p *gitlab.Project) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			repos[idx] = fetchRepoInfo(ctx, p)
+		}(idx, p)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err // repos contains errors instead of debian/control
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Repo < repos[j].Repo })
+	return repos, nil
+}
+
+func fetchRepoInfo(ctx context.Context, p *gitlab.Project) *repoInfo {
+	ri := &repoInfo{
+		Repo:          p.PathWithNamespace,
+		URL:           p.WebURL,
+		DefaultBranch: p.DefaultBranch,
+	}
+	if p.DefaultBranch == "" {
+		ri.Error = "repository is empty"
+		return ri
+	}
+	b, _, err := salsa.RepositoryFiles.GetRawFile(p.ID, "debian/control", &gitlab.GetRawFileOptions{
+		Ref: gitlab.String(p.DefaultBranch),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		ri.Error = fmt.Sprintf("fetching debian/control: %v", err)
+		return ri
+	}
+	var s controlSource
+	if err := control.Unmarshal(&s, bytes.NewReader(b)); err != nil {
+		ri.Error = fmt.Sprintf("parsing debian/control: %v", err)
+		return ri
+	}
+	ri.Source = s.Source
+	ri.Maintainer = s.Maintainer
+	for _, u := range strings.Split(s.Uploaders, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			ri.Uploaders = append(ri.Uploaders, u)
+		}
+	}
+	ri.GoImportPath = s.GoImportPath
+	ri.VcsGit = s.VcsGit
+	ri.StandardsVersion = s.StandardsVersion
+	return ri
+}
+
+// repos lists all repositories underneath the configured groups, joined with
+// metadata from their debian/control.
+//
+// The following URL parameters are supported:
+//
+//	format=json|csv    output format (default json)
+//	missing=<field>    only list repos where <field> is empty (repeatable)
+//	<field>=<value>    only list repos where <field> contains <value>
+//	                   (case-insensitive, repeatable)
+//	refresh=1          bypass the cache (requires authentication, see
+//	                   -inventory_min_refresh)
+func repos(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		http.Error(w, "this URL requires HTTP GET", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	type filter struct {
+		value   func(*repoInfo) string
+		missing bool
+		substr  string
+	}
+	var filters []filter
+	for key, vals := range r.Form {
+		if key == "format" || key == "refresh" {
+			continue
+		}
+		for _, val := range vals {
+			name, substr := key, strings.ToLower(val)
+			missing := key == "missing"
+			if missing {
+				name = val
+			}
+			value, ok := inventoryField(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown field %q", name), http.StatusBadRequest)
+				return nil
+			}
+			filters = append(filters, filter{value: value, missing: missing, substr: substr})
+		}
+	}
+
+	refresh := r.FormValue("refresh") == "1"
+	if refresh {
+		// Re-fetching is expensive for salsa, so it is subject to the same
+		// restrictions as requests which modify repositories.
+		if _, ok := activeConfig().authenticate(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pgt-api-server"`)
+			http.Error(w, "refresh=1 requires a valid bearer token", http.StatusUnauthorized)
+			return nil
+		}
+		if err := limiter.Wait(r.Context()); err != nil {
+			return err
+		}
+	}
+	all, fetched, err := repoInventory.get(r.Context(), refresh)
+	if err != nil {
+		return err
+	}
+	matching := []*repoInfo{} // marshal as [] instead of null
+	for _, ri := range all {
+		match := true
+		for _, f := range filters {
+			val := f.value(ri)
+			if f.missing && val != "" ||
+				!f.missing && !strings.Contains(strings.ToLower(val), f.substr) {
+				match = false
+				break
+			}
+		}
+		if match {
+			matching = append(matching, ri)
+		}
+	}
+
+	w.Header().Set("Last-Modified", fetched.UTC().Format(http.TimeFormat))
+	switch format := r.FormValue("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		b, err := json.MarshalIndent(matching, "", "  ")
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		record := make([]string, len(inventoryFields))
+		for idx, f := range inventoryFields {
+			record[idx] = f.name
+		}
+		cw.Write(record)
+		for _, ri := range matching {
+			for idx, f := range inventoryFields {
+				record[idx] = f.value(ri)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	notifySMTP = flag.String("notify_smtp",
+		"",
+		"host:port of an SMTP server to send repository event notifications through. Empty disables e-mail notifications.")
+
+	notifySMTPFrom = flag.String("notify_smtp_from",
+		"pgt-api-server@debian.net",
+		"Envelope and header sender of notification e-mails")
+
+	notifySMTPTo = flag.String("notify_smtp_to",
+		"debian-go@lists.debian.org",
+		"Comma-separated list of notification e-mail recipients")
+
+	notifyWebhook = flag.String("notify_webhook",
+		"",
+		"URL to POST repository events to as JSON. Empty disables the webhook.")
+
+	notifyChatWebhook = flag.String("notify_chat_webhook",
+		"",
+		"URL of an IRC/Matrix bridge (e.g. matterbridge’s API) to POST a one-line message to. Empty disables chat notifications.")
+)
+
+// Kinds of repository events.
+const (
+	eventCreate        = "create"
+	eventTransfer      = "transfer"
+	eventArchive       = "archive"
+	eventConfigFailure = "config-failure"
+)
+
+// event describes a change to a repository underneath the team group which the
+// rest of the team should learn about.
+type event struct {
+	Kind  string    `json:"kind"`
+	Repo  string    `json:"repo"` // e.g. go-team/packages/golang-github-foo-bar
+	URL   string    `json:"url,omitempty"`
+	From  string    `json:"from,omitempty"`  // previous repo, set for eventTransfer
+	Error string    `json:"error,omitempty"` // set for eventConfigFailure
+	Time  time.Time `json:"time"`
+
+	// RequestID identifies the request to pgt-api-server which resulted in
+	// this event.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// A sink delivers a rendered event to one destination.
+type sink interface {
+	send(ev *event) error
+}
+
+// notifySink pairs a sink with its retry behavior.
+type notifySink struct {
+	name     string
+	sink     sink
+	attempts int
+	backoff  time.Duration // doubled after each failed attempt
+}
+
+func (ns *notifySink) deliver(ev *event) {
+	attempts := ns.attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := ns.backoff
+	for attempt := 1; ; attempt++ {
+		err := ns.sink.send(ev)
+		if err == nil {
+			return
+		}
+		if attempt >= attempts {
+			log.Printf("[%s] notify(%s): giving up on %s event for %s after %d attempts: %v", ev.RequestID, ns.name, ev.Kind, ev.Repo, attempt, err)
+			return
+		}
+		log.Printf("[%s] notify(%s): attempt %d/%d: %v (retrying in %v)", ev.RequestID, ns.name, attempt, attempts, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notifier fans out events to all configured sinks.
+type notifier struct {
+	sinks []*notifySink
+}
+
+// notify delivers ev to all sinks in the background, so that HTTP handlers
+// are not delayed by slow or unavailable sinks.
+func (n *notifier) notify(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, ns := range n.sinks {
+		go ns.deliver(&ev)
+	}
+}
+
+func render(tmpl *template.Template, ev *event) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ev); err != nil {
+		return "", fmt.Errorf("rendering template %s: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// smtpSink sends an e-mail, e.g. to the team mailing list.
+type smtpSink struct {
+	addr    string
+	from    string
+	to      []string
+	subject *template.Template
+	body    *template.Template
+}
+
+func (s *smtpSink) send(ev *event) error {
+	subject, err := render(s.subject, ev)
+	if err != nil {
+		return err
+	}
+	body, err := render(s.body, ev)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.TrimSpace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(s.addr, nil, s.from, s.to, msg.Bytes())
+}
+
+// webhookSink POSTs the rendered template (by default, the event as JSON).
+type webhookSink struct {
+	url  string
+	body *template.Template
+}
+
+func (s *webhookSink) send(ev *event) error {
+	body, err := render(s.body, ev)
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, []byte(body))
+}
+
+// chatSink posts a one-line message to an IRC/Matrix bridge which accepts
+// messages via a webhook, such as matterbridge’s API.
+type chatSink struct {
+	url      string
+	username string
+	message  *template.Template
+}
+
+func (s *chatSink) send(ev *event) error {
+	msg, err := render(s.message, ev)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(struct {
+		Text     string `json:"text"`
+		Username string `json:"username,omitempty"`
+	}{
+		Text:     strings.TrimSpace(msg),
+		Username: s.username,
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, b)
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+func postJSON(url string, body []byte) error {
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode/100, 2; got != want {
+		return fmt.Errorf("POST %s: unexpected HTTP status: %v", url, resp.Status)
+	}
+	return nil
+}
+
+const (
+	defaultSMTPSubject = `[pgt-api-server] {{.Kind}}: {{.Repo}}`
+
+	defaultSMTPBody = `{{if eq .Kind "create"}}The repository {{.Repo}} was created.
+{{else if eq .Kind "transfer"}}The repository {{.From}} was transferred to {{.Repo}}.
+{{else if eq .Kind "archive"}}The repository {{.Repo}} was archived.
+{{else if eq .Kind "config-failure"}}Configuring the repository {{.Repo}} failed:
+
+    {{.Error}}
+{{end}}{{with .URL}}
+{{.}}
+{{end}}{{with .RequestID}}
+Request ID: {{.}}
+{{end}}
+--
+pgt-api-server
+`
+
+	defaultWebhookBody = `{{json .}}`
+
+	defaultChatMessage = `{{.Kind}}: {{.Repo}}{{with .From}} (from {{.}}){{end}}{{with .URL}} {{.}}{{end}}{{with .Error}} ({{.}}){{end}}`
+)
+
+// newNotifier returns a notifier for all sinks in cfg.
+func newNotifier(cfg *notifyConfig) (*notifier, error) {
+	n := &notifier{}
+	parse := func(name, text, def string) (*template.Template, error) {
+		if text == "" {
+			text = def
+		}
+		return template.New(name).Funcs(templateFuncs).Parse(text)
+	}
+	for _, c := range cfg.SMTP {
+		if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp: addr, from and to must be set")
+		}
+		subject, err := parse("subject", c.SubjectTemplate, defaultSMTPSubject)
+		if err != nil {
+			return nil, err
+		}
+		body, err := parse("body", c.BodyTemplate, defaultSMTPBody)
+		if err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, &notifySink{
+			name: "smtp " + c.Addr,
+			sink: &smtpSink{
+				addr:    c.Addr,
+				from:    c.From,
+				to:      c.To,
+				subject: subject,
+				body:    body,
+			},
+			attempts: c.Attempts,
+			backoff:  c.Backoff.Duration,
+		})
+	}
+	for _, c := range cfg.Webhooks {
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhooks: url must be set")
+		}
+		body, err := parse("body", c.BodyTemplate, defaultWebhookBody)
+		if err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, &notifySink{
+			name:     "webhook " + c.URL,
+			sink:     &webhookSink{url: c.URL, body: body},
+			attempts: c.Attempts,
+			backoff:  c.Backoff.Duration,
+		})
+	}
+	for _, c := range cfg.Chat {
+		if c.URL == "" {
+			return nil, fmt.Errorf("chat: url must be set")
+		}
+		message, err := parse("message", c.MessageTemplate, defaultChatMessage)
+		if err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, &notifySink{
+			name: "chat " + c.URL,
+			sink: &chatSink{
+				url:      c.URL,
+				username: c.Username,
+				message:  message,
+			},
+			attempts: c.Attempts,
+			backoff:  c.Backoff.Duration,
+		})
+	}
+	return n, nil
+}
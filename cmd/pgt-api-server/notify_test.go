@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server which accepts messages (without
+// STARTTLS or AUTH), failing the first failures transactions with a
+// temporary error.
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	messages []string
+}
+
+func newFakeSMTP(t *testing.T, failures int) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, failures: failures}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250 localhost")
+		case "MAIL":
+			s.mu.Lock()
+			s.attempts++
+			fail := s.attempts <= s.failures
+			s.mu.Unlock()
+			if fail {
+				tc.PrintfLine("451 try again later")
+				continue
+			}
+			tc.PrintfLine("250 OK")
+		case "RCPT", "RSET", "NOOP":
+			tc.PrintfLine("250 OK")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			b, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(b))
+			s.mu.Unlock()
+			tc.PrintfLine("250 OK")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) received() (attempts int, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts, append([]string(nil), s.messages...)
+}
+
+func smtpNotifier(t *testing.T, c smtpSinkConfig) *notifySink {
+	t.Helper()
+	n, err := newNotifier(&notifyConfig{SMTP: []smtpSinkConfig{c}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(n.sinks), 1; got != want {
+		t.Fatalf("unexpected number of sinks: got %d, want %d", got, want)
+	}
+	return n.sinks[0]
+}
+
+// header returns the value of the header key of the e-mail msg.
+func header(t *testing.T, msg, key string) string {
+	t.Helper()
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.Get(key)
+}
+
+func TestSMTPDefaultTemplates(t *testing.T) {
+	for _, tt := range []struct {
+		ev       event
+		wantBody []string
+	}{
+		{
+			ev:       event{Kind: eventCreate, Repo: "go-team/packages/golang-foo", URL: "https://salsa.debian.org/go-team/packages/golang-foo"},
+			wantBody: []string{"The repository go-team/packages/golang-foo was created.", "https://salsa.debian.org/go-team/packages/golang-foo"},
+		},
+		{
+			ev:       event{Kind: eventTransfer, Repo: "go-team/attic/golang-foo", From: "go-team/packages/golang-foo"},
+			wantBody: []string{"The repository go-team/packages/golang-foo was transferred to go-team/attic/golang-foo."},
+		},
+		{
+			ev:       event{Kind: eventArchive, Repo: "go-team/packages/golang-foo"},
+			wantBody: []string{"The repository go-team/packages/golang-foo was archived."},
+		},
+		{
+			ev:       event{Kind: eventConfigFailure, Repo: "go-team/packages/golang-foo", Error: "webhook: 500", RequestID: "abc123"},
+			wantBody: []string{"Configuring the repository go-team/packages/golang-foo failed:", "    webhook: 500", "Request ID: abc123"},
+		},
+	} {
+		t.Run(tt.ev.Kind, func(t *testing.T) {
+			srv := newFakeSMTP(t, 0)
+			ns := smtpNotifier(t, smtpSinkConfig{
+				Addr: srv.addr(),
+				From: "pgt-api-server@debian.net",
+				To:   []string{"debian-go@lists.debian.org"},
+			})
+			ev := tt.ev
+			ev.Time = time.Now()
+			ns.deliver(&ev)
+
+			_, messages := srv.received()
+			if got, want := len(messages), 1; got != want {
+				t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+			}
+			msg := messages[0]
+			if got, want := header(t, msg, "Subject"), fmt.Sprintf("[pgt-api-server] %s: %s", tt.ev.Kind, tt.ev.Repo); got != want {
+				t.Errorf("unexpected Subject: got %q, want %q", got, want)
+			}
+			if got, want := header(t, msg, "To"), "debian-go@lists.debian.org"; got != want {
+				t.Errorf("unexpected To: got %q, want %q", got, want)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(msg, want) {
+					t.Errorf("message does not contain %q:\n%s", want, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPCustomTemplates(t *testing.T) {
+	srv := newFakeSMTP(t, 0)
+	ns := smtpNotifier(t, smtpSinkConfig{
+		Addr:            srv.addr(),
+		From:            "pgt-api-server@debian.net",
+		To:              []string{"a@example.net", "b@example.net"},
+		SubjectTemplate: `{{.Repo}} ({{.Kind}})`,
+		BodyTemplate:    `event: {{json .}}`,
+	})
+	ns.deliver(&event{Kind: eventArchive, Repo: "go-team/packages/golang-foo", Time: time.Now()})
+
+	_, messages := srv.received()
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("unexpected number of messages: got %d, want %d", got, want)
+	}
+	msg := messages[0]
+	if got, want := header(t, msg, "Subject"), "go-team/packages/golang-foo (archive)"; got != want {
+		t.Errorf("unexpected Subject: got %q, want %q", got, want)
+	}
+	if got, want := header(t, msg, "To"), "a@example.net, b@example.net"; got != want {
+		t.Errorf("unexpected To: got %q, want %q", got, want)
+	}
+	if want := `event: {"kind":"archive","repo":"go-team/packages/golang-foo"`; !strings.Contains(msg, want) {
+		t.Errorf("message does not contain %q:\n%s", want, msg)
+	}
+}
+
+func TestSMTPRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		failures     int
+		attempts     int
+		wantAttempts int
+		wantMessages int
+	}{
+		{name: "FirstAttempt", failures: 0, attempts: 3, wantAttempts: 1, wantMessages: 1},
+		{name: "Recovers", failures: 2, attempts: 3, wantAttempts: 3, wantMessages: 1},
+		{name: "GivesUp", failures: 5, attempts: 3, wantAttempts: 3, wantMessages: 0},
+		{name: "DefaultsToOneAttempt", failures: 1, attempts: 0, wantAttempts: 1, wantMessages: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeSMTP(t, tt.failures)
+			ns := smtpNotifier(t, smtpSinkConfig{
+				Addr:        srv.addr(),
+				From:        "pgt-api-server@debian.net",
+				To:          []string{"debian-go@lists.debian.org"},
+				retryConfig: retryConfig{Attempts: tt.attempts, Backoff: duration{1 * time.Millisecond}},
+			})
+			ns.deliver(&event{Kind: eventCreate, Repo: "go-team/packages/golang-foo", Time: time.Now()})
+
+			attempts, messages := srv.received()
+			if attempts != tt.wantAttempts {
+				t.Errorf("unexpected number of attempts: got %d, want %d", attempts, tt.wantAttempts)
+			}
+			if got := len(messages); got != tt.wantMessages {
+				t.Errorf("unexpected number of messages: got %d, want %d", got, tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestSMTPBackoff(t *testing.T) {
+	srv := newFakeSMTP(t, 2)
+	ns := smtpNotifier(t, smtpSinkConfig{
+		Addr:        srv.addr(),
+		From:        "pgt-api-server@debian.net",
+		To:          []string{"debian-go@lists.debian.org"},
+		retryConfig: retryConfig{Attempts: 3, Backoff: duration{50 * time.Millisecond}},
+	})
+	start := time.Now()
+	ns.deliver(&event{Kind: eventCreate, Repo: "go-team/packages/golang-foo", Time: time.Now()})
+	// 50ms after the first attempt, 100ms after the second:
+	if got, want := time.Since(start), 150*time.Millisecond; got < want {
+		t.Errorf("delivery took %v, want at least %v (doubling backoff)", got, want)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+var protectionPolicyPath = flag.String("protection_policy",
+	"",
+	"Path to a JSON file containing the branch and tag protection policy to apply to all repositories. Empty uses the built-in team policy.")
+
+// accessLevel is a GitLab access level, (un)marshaled by name (e.g.
+// “developer”) for readable policy files.
+type accessLevel gitlab.AccessLevelValue
+
+var accessLevelNames = map[accessLevel]string{
+	0:  "none",
+	30: "developer",
+	40: "maintainer",
+	60: "admin",
+}
+
+func (l accessLevel) String() string {
+	if name, ok := accessLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+func (l accessLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *accessLevel) UnmarshalText(text []byte) error {
+	for level, name := range accessLevelNames {
+		if name == string(text) {
+			*l = level
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown access level %q", string(text))
+}
+
+// branchRule describes a protected branch (or wildcard, e.g. debian/*).
+type branchRule struct {
+	Name  string      `json:"name"`
+	Push  accessLevel `json:"push"`  // minimum level allowed to push
+	Merge accessLevel `json:"merge"` // minimum level allowed to merge
+}
+
+func (r branchRule) String() string {
+	return fmt.Sprintf("branch %s (push: %v, merge: %v)", r.Name, r.Push, r.Merge)
+}
+
+// tagRule describes a protected tag (or wildcard). Protected tags can only be
+// created by the specified level and cannot be deleted by anyone lacking
+// maintainer permissions.
+type tagRule struct {
+	Name   string      `json:"name"`
+	Create accessLevel `json:"create"` // minimum level allowed to create
+}
+
+func (r tagRule) String() string {
+	return fmt.Sprintf("tag %s (create: %v)", r.Name, r.Create)
+}
+
+// protectionPolicy declares the protection rules each repository should have.
+// Rules present on the repository but absent from the policy (e.g. GitLab’s
+// default protection for master) are left alone.
+type protectionPolicy struct {
+	Branches []branchRule `json:"branches"`
+	Tags     []tagRule    `json:"tags"`
+}
+
+// defaultProtectionPolicy implements the team policy: the branches
+// git-buildpackage works with must not be force-pushed or deleted, and release
+// tags must not be deleted.
+var defaultProtectionPolicy = &protectionPolicy{
+	Branches: []branchRule{
+		{Name: "debian/sid", Push: 30, Merge: 30},
+		{Name: "upstream", Push: 30, Merge: 30},
+		{Name: "pristine-tar", Push: 30, Merge: 30},
+	},
+	Tags: []tagRule{
+		{Name: "debian/*", Create: 30},
+		{Name: "upstream/*", Create: 30},
+	},
+}
+
+func loadProtectionPolicy(path string) (*protectionPolicy, error) {
+	if path == "" {
+		return defaultProtectionPolicy, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p protectionPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// protectionForge is the subset of forge functionality which applying a
+// protectionPolicy requires. It is implemented by salsaForge for production,
+// and can be implemented in-memory for verifying policies.
+type protectionForge interface {
+	protectedBranches(pid int) ([]branchRule, error)
+	protectBranch(pid int, r branchRule) error
+	unprotectBranch(pid int, name string) error
+
+	protectedTags(pid int) ([]tagRule, error)
+	protectTag(pid int, r tagRule) error
+	unprotectTag(pid int, name string) error
+}
+
+// applyProtection brings the protection rules of project pid in line with
+// policy, returning a human-readable description of each rule it added or
+// changed. Should re-protecting a changed rule fail, the previous rule is
+// restored.
+func applyProtection(f protectionForge, pid int, policy *protectionPolicy) ([]string, error) {
+	var changes []string
+
+	branches, err := f.protectedBranches(pid)
+	if err != nil {
+		return nil, fmt.Errorf("listing protected branches: %v", err)
+	}
+	existingBranches := make(map[string]branchRule, len(branches))
+	for _, b := range branches {
+		existingBranches[b.Name] = b
+	}
+	for _, want := range policy.Branches {
+		got, ok := existingBranches[want.Name]
+		if ok && got == want {
+			continue
+		}
+		if ok {
+			// GitLab cannot modify protected branches in-place:
+			if err := f.unprotectBranch(pid, want.Name); err != nil {
+				return changes, fmt.Errorf("unprotecting branch %s: %v", want.Name, err)
+			}
+		}
+		if err := f.protectBranch(pid, want); err != nil {
+			err = fmt.Errorf("protecting branch %s: %v", want.Name, err)
+			if ok {
+				// Do not leave the branch unprotected:
+				if rerr := f.protectBranch(pid, got); rerr != nil {
+					err = fmt.Errorf("%v; restoring previous rule failed, branch is UNPROTECTED: %v", err, rerr)
+				}
+			}
+			return changes, err
+		}
+		if ok {
+			changes = append(changes, fmt.Sprintf("changed %v, was %v", want, got))
+		} else {
+			changes = append(changes, fmt.Sprintf("added %v", want))
+		}
+	}
+
+	tags, err := f.protectedTags(pid)
+	if err != nil {
+		return changes, fmt.Errorf("listing protected tags: %v", err)
+	}
+	existingTags := make(map[string]tagRule, len(tags))
+	for _, t := range tags {
+		existingTags[t.Name] = t
+	}
+	for _, want := range policy.Tags {
+		got, ok := existingTags[want.Name]
+		if ok && got == want {
+			continue
+		}
+		if ok {
+			if err := f.unprotectTag(pid, want.Name); err != nil {
+				return changes, fmt.Errorf("unprotecting tag %s: %v", want.Name, err)
+			}
+		}
+		if err := f.protectTag(pid, want); err != nil {
+			err = fmt.Errorf("protecting tag %s: %v", want.Name, err)
+			if ok {
+				if rerr := f.protectTag(pid, got); rerr != nil {
+					err = fmt.Errorf("%v; restoring previous rule failed, tag is UNPROTECTED: %v", err, rerr)
+				}
+			}
+			return changes, err
+		}
+		if ok {
+			changes = append(changes, fmt.Sprintf("changed %v, was %v", want, got))
+		} else {
+			changes = append(changes, fmt.Sprintf("added %v", want))
+		}
+	}
+
+	return changes, nil
+}
+
+// salsaForge implements protectionForge using the GitLab API.
+type salsaForge struct {
+	ctx context.Context // of the request to pgt-api-server
+	cl  *gitlab.Client
+}
+
+// minLevel returns the lowest of levels, which is the effective access level
+// of a rule.
+func minLevel(levels []gitlab.AccessLevelValue) accessLevel {
+	if len(levels) == 0 {
+		return 0
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	return accessLevel(levels[0])
+}
+
+func (f *salsaForge) protectedBranches(pid int) ([]branchRule, error) {
+	var rules []branchRule
+	opt := &gitlab.ListProtectedBranchesOptions{PerPage: 100}
+	for {
+		branches, resp, err := f.cl.ProtectedBranches.ListProtectedBranches(pid, opt, gitlab.WithContext(f.ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range branches {
+			var push, merge []gitlab.AccessLevelValue
+			for _, d := range b.PushAccessLevels {
+				push = append(push, d.AccessLevel)
+			}
+			for _, d := range b.MergeAccessLevels {
+				merge = append(merge, d.AccessLevel)
+			}
+			rules = append(rules, branchRule{
+				Name:  b.Name,
+				Push:  minLevel(push),
+				Merge: minLevel(merge),
+			})
+		}
+		if resp.NextPage == 0 {
+			return rules, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (f *salsaForge) protectBranch(pid int, r branchRule) error {
+	_, _, err := f.cl.ProtectedBranches.ProtectRepositoryBranches(pid, &gitlab.ProtectRepositoryBranchesOptions{
+		Name:             gitlab.String(r.Name),
+		PushAccessLevel:  gitlab.AccessLevel(gitlab.AccessLevelValue(r.Push)),
+		MergeAccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(r.Merge)),
+	}, gitlab.WithContext(f.ctx))
+	return err
+}
+
+func (f *salsaForge) unprotectBranch(pid int, name string) error {
+	_, err := f.cl.ProtectedBranches.UnprotectRepositoryBranches(pid, name, gitlab.WithContext(f.ctx))
+	return err
+}
+
+func (f *salsaForge) protectedTags(pid int) ([]tagRule, error) {
+	var rules []tagRule
+	opt := &gitlab.ListProtectedTagsOptions{PerPage: 100}
+	for {
+		tags, resp, err := f.cl.ProtectedTags.ListProtectedTags(pid, opt, gitlab.WithContext(f.ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			var create []gitlab.AccessLevelValue
+			for _, d := range t.CreateAccessLevels {
+				create = append(create, d.AccessLevel)
+			}
+			rules = append(rules, tagRule{
+				Name:   t.Name,
+				Create: minLevel(create),
+			})
+		}
+		if resp.NextPage == 0 {
+			return rules, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (f *salsaForge) protectTag(pid int, r tagRule) error {
+	_, _, err := f.cl.ProtectedTags.ProtectRepositoryTags(pid, &gitlab.ProtectRepositoryTagsOptions{
+		Name:              gitlab.String(r.Name),
+		CreateAccessLevel: gitlab.AccessLevel(gitlab.AccessLevelValue(r.Create)),
+	}, gitlab.WithContext(f.ctx))
+	return err
+}
+
+func (f *salsaForge) unprotectTag(pid int, name string) error {
+	_, err := f.cl.ProtectedTags.UnprotectRepositoryTags(pid, name, gitlab.WithContext(f.ctx))
+	return err
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeForge is an in-memory protectionForge.
+type fakeForge struct {
+	branches map[string]branchRule
+	tags     map[string]tagRule
+
+	// failProtect makes protectBranch and protectTag fail for the rules it
+	// returns true for.
+	failProtect func(rule interface{}) bool
+
+	calls []string
+}
+
+func newFakeForge() *fakeForge {
+	return &fakeForge{
+		branches: make(map[string]branchRule),
+		tags:     make(map[string]tagRule),
+	}
+}
+
+func (f *fakeForge) protectedBranches(pid int) ([]branchRule, error) {
+	var rules []branchRule
+	for _, r := range f.branches {
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (f *fakeForge) protectBranch(pid int, r branchRule) error {
+	f.calls = append(f.calls, "protect "+r.String())
+	if f.failProtect != nil && f.failProtect(r) {
+		return fmt.Errorf("fake failure")
+	}
+	if _, ok := f.branches[r.Name]; ok {
+		return fmt.Errorf("branch %s is already protected", r.Name) // like GitLab
+	}
+	f.branches[r.Name] = r
+	return nil
+}
+
+func (f *fakeForge) unprotectBranch(pid int, name string) error {
+	f.calls = append(f.calls, "unprotect branch "+name)
+	delete(f.branches, name)
+	return nil
+}
+
+func (f *fakeForge) protectedTags(pid int) ([]tagRule, error) {
+	var rules []tagRule
+	for _, r := range f.tags {
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (f *fakeForge) protectTag(pid int, r tagRule) error {
+	f.calls = append(f.calls, "protect "+r.String())
+	if f.failProtect != nil && f.failProtect(r) {
+		return fmt.Errorf("fake failure")
+	}
+	if _, ok := f.tags[r.Name]; ok {
+		return fmt.Errorf("tag %s is already protected", r.Name)
+	}
+	f.tags[r.Name] = r
+	return nil
+}
+
+func (f *fakeForge) unprotectTag(pid int, name string) error {
+	f.calls = append(f.calls, "unprotect tag "+name)
+	delete(f.tags, name)
+	return nil
+}
+
+// rules returns all rules of f, sorted.
+func (f *fakeForge) rules() []string {
+	var rules []string
+	for _, r := range f.branches {
+		rules = append(rules, r.String())
+	}
+	for _, r := range f.tags {
+		rules = append(rules, r.String())
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func policyRules(p *protectionPolicy) []string {
+	var rules []string
+	for _, r := range p.Branches {
+		rules = append(rules, r.String())
+	}
+	for _, r := range p.Tags {
+		rules = append(rules, r.String())
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func TestApplyProtectionAdded(t *testing.T) {
+	f := newFakeForge()
+	changes, err := applyProtection(f, 1, defaultProtectionPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"added branch debian/sid (push: developer, merge: developer)",
+		"added branch upstream (push: developer, merge: developer)",
+		"added branch pristine-tar (push: developer, merge: developer)",
+		"added tag debian/* (create: developer)",
+		"added tag upstream/* (create: developer)",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("unexpected changes: got %q, want %q", changes, want)
+	}
+	if got, want := f.rules(), policyRules(defaultProtectionPolicy); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected rules: got %q, want %q", got, want)
+	}
+}
+
+func TestApplyProtectionUnchanged(t *testing.T) {
+	f := newFakeForge()
+	for _, r := range defaultProtectionPolicy.Branches {
+		f.branches[r.Name] = r
+	}
+	for _, r := range defaultProtectionPolicy.Tags {
+		f.tags[r.Name] = r
+	}
+	// Rules which are not part of the policy are left alone:
+	master := branchRule{Name: "master", Push: 40, Merge: 40}
+	f.branches[master.Name] = master
+
+	changes, err := applyProtection(f, 1, defaultProtectionPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("unexpected changes: %q", changes)
+	}
+	if len(f.calls) > 0 {
+		t.Errorf("unexpected forge calls: %q", f.calls)
+	}
+	if got := f.branches[master.Name]; got != master {
+		t.Errorf("master protection modified: got %v, want %v", got, master)
+	}
+}
+
+func TestApplyProtectionChanged(t *testing.T) {
+	f := newFakeForge()
+	for _, r := range defaultProtectionPolicy.Branches {
+		f.branches[r.Name] = r
+	}
+	for _, r := range defaultProtectionPolicy.Tags {
+		f.tags[r.Name] = r
+	}
+	f.branches["debian/sid"] = branchRule{Name: "debian/sid", Push: 40, Merge: 30}
+	f.tags["upstream/*"] = tagRule{Name: "upstream/*", Create: 40}
+
+	changes, err := applyProtection(f, 1, defaultProtectionPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"changed branch debian/sid (push: developer, merge: developer), was branch debian/sid (push: maintainer, merge: developer)",
+		"changed tag upstream/* (create: developer), was tag upstream/* (create: maintainer)",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("unexpected changes: got %q, want %q", changes, want)
+	}
+	if got, want := f.rules(), policyRules(defaultProtectionPolicy); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected rules: got %q, want %q", got, want)
+	}
+}
+
+func TestApplyProtectionRollback(t *testing.T) {
+	oldBranch := branchRule{Name: "debian/sid", Push: 40, Merge: 40}
+	oldTag := tagRule{Name: "debian/*", Create: 40}
+	for _, tt := range []struct {
+		name string
+		fail func(rule interface{}) bool
+		want string // rule which must still be protected
+	}{
+		{
+			name: "Branch",
+			fail: func(rule interface{}) bool {
+				r, ok := rule.(branchRule)
+				return ok && r != oldBranch
+			},
+			want: oldBranch.String(),
+		},
+		{
+			name: "Tag",
+			fail: func(rule interface{}) bool {
+				r, ok := rule.(tagRule)
+				return ok && r != oldTag
+			},
+			want: oldTag.String(),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeForge()
+			f.branches[oldBranch.Name] = oldBranch
+			f.tags[oldTag.Name] = oldTag
+			f.failProtect = tt.fail
+			if _, err := applyProtection(f, 1, defaultProtectionPolicy); err == nil {
+				t.Fatalf("applyProtection unexpectedly succeeded")
+			}
+			var found bool
+			for _, r := range f.rules() {
+				if r == tt.want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("previous rule %s not restored, rules: %q", tt.want, f.rules())
+			}
+		})
+	}
+}
+
+func TestApplyProtectionRollbackFails(t *testing.T) {
+	f := newFakeForge()
+	f.branches["debian/sid"] = branchRule{Name: "debian/sid", Push: 40, Merge: 40}
+	f.failProtect = func(interface{}) bool { return true }
+	_, err := applyProtection(f, 1, defaultProtectionPolicy)
+	if err == nil {
+		t.Fatalf("applyProtection unexpectedly succeeded")
+	}
+	if !strings.Contains(err.Error(), "UNPROTECTED") {
+		t.Errorf("error does not mention the unprotected branch: %v", err)
+	}
+}
+
+func TestLoadProtectionPolicy(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "policy.json")
+	const policy = `{
+  "branches": [{"name": "debian/*", "push": "maintainer", "merge": "developer"}],
+  "tags": [{"name": "upstream/*", "create": "none"}]
+}`
+	if err := ioutil.WriteFile(fn, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadProtectionPolicy(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &protectionPolicy{
+		Branches: []branchRule{{Name: "debian/*", Push: 40, Merge: 30}},
+		Tags:     []tagRule{{Name: "upstream/*", Create: 0}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("unexpected policy: got %+v, want %+v", p, want)
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(`{"branches": [{"name": "x", "push": "owner"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadProtectionPolicy(fn); err == nil {
+		t.Errorf("loadProtectionPolicy unexpectedly accepted an unknown access level")
+	}
+}
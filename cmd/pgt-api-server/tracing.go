@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	tracing = flag.String("tracing",
+		"none",
+		"Where to export OpenTelemetry spans to: none, stdout or otlp")
+
+	otlpEndpoint = flag.String("otlp_endpoint",
+		"localhost:4318",
+		"host:port of the OTLP/HTTP collector to export spans to when -tracing=otlp")
+
+	auditLogPath = flag.String("audit_log",
+		"",
+		"Path of a file to append audit records (one JSON object per line) to. Audit records are always logged to stderr as well.")
+)
+
+// requestIDHeader carries the request ID in requests to pgt-api-server, in its
+// responses and in requests to salsa.
+const requestIDHeader = "X-Request-Id"
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// validRequestID restricts client-supplied request IDs to something which is
+// safe to put into log lines and HTTP headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand must not fail
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the request ID associated with ctx, or "-" if none.
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// withRequestID associates each request with the request ID the client
+// supplied or a newly generated one, and returns it in the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// logf is like log.Printf, but prefixes the message with the request ID of
+// ctx.
+func logf(ctx context.Context, format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf("[%s] ", requestID(ctx))+fmt.Sprintf(format, v...))
+}
+
+var tracer = otel.Tracer("pgt-api-server")
+
+// setupTracing installs a global OpenTelemetry tracer provider as configured
+// by the -tracing flag. The returned function flushes pending spans.
+func setupTracing() (shutdown func(context.Context) error, _ error) {
+	var exporter sdktrace.SpanExporter
+	switch *tracing {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	case "otlp":
+		exp, err := otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpoint(*otlpEndpoint),
+			otlptracehttp.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("unknown -tracing value %q: expected none, stdout or otlp", *tracing)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// traced wraps h in a span named name, continuing the client’s trace (if any).
+func traced(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name)
+		defer span.End()
+		span.SetAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.String("request_id", requestID(ctx)))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceOp runs fn (typically a forge operation) in a span named name.
+func traceOp(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// salsaTransport propagates the request ID and trace context of a request to
+// pgt-api-server into the requests to salsa it results in.
+type salsaTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *salsaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "salsa "+req.Method+" "+req.URL.Path)
+	defer span.End()
+	req = req.Clone(ctx) // RoundTrippers must not modify the request
+	if id := requestID(ctx); id != "-" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	return resp, nil
+}
+
+// auditRecord describes an action a user requested.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Source    string    `json:"source"` // client address
+	User      string    `json:"user"`
+	Action    string    `json:"action"` // e.g. createrepo
+	Repo      string    `json:"repo"`
+}
+
+var auditLog struct {
+	sync.Mutex
+	f *os.File
+}
+
+func openAuditLog() error {
+	if *auditLogPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog.f = f
+	return nil
+}
+
+// audit records that user requested action on repo.
+func audit(r *http.Request, user, action, repo string) {
+	rec := auditRecord{
+		Time:      time.Now(),
+		RequestID: requestID(r.Context()),
+		Source:    clientAddr(r),
+		User:      user,
+		Action:    action,
+		Repo:      repo,
+	}
+	logf(r.Context(), "audit: %s (%s) requested %s of %s", rec.User, rec.Source, rec.Action, rec.Repo)
+	if auditLog.f == nil {
+		return
+	}
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		logf(r.Context(), "audit: %v", err)
+		return
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if _, err := auditLog.f.Write(append(b, '\n')); err != nil {
+		logf(r.Context(), "audit: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// transferRepo moves the specified repo from its group (default
+// go-team/packages) to another configured group, specified by the “to”
+// parameter.
+func transferRepo(w http.ResponseWriter, r *http.Request) error {
+	user, g, name, ok := repoRequest(w, r)
+	if !ok {
+		return nil
+	}
+	if r.FormValue("to") == "" {
+		http.Error(w, `no "to" parameter found`, http.StatusBadRequest)
+		return nil
+	}
+	to, err := activeConfig().group(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if to.Path == g.Path {
+		http.Error(w, `"to" must differ from "group"`, http.StatusBadRequest)
+		return nil
+	}
+	repo := path.Join(g.Path, name)
+
+	audit(r, user, "transferrepo", repo)
+
+	ctx := r.Context()
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	var p *gitlab.Project
+	err = traceOp(ctx, "TransferProject", func(ctx context.Context) error {
+		var err error
+		p, _, err = salsa.Projects.TransferProject(repo, &gitlab.TransferProjectOptions{
+			Namespace: to.NamespaceID,
+		}, gitlab.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("TransferProject(%q, %q): %v", repo, to.Path, err)
+	}
+	activeConfig().notifier.notify(event{Kind: eventTransfer, Repo: path.Join(to.Path, name), From: repo, URL: p.WebURL, RequestID: requestID(ctx)})
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pault.ag/go/archive"
+	"pault.ag/go/debian/control"
+)
+
+// dscControl is a .dsc file, which names the source package in its Source
+// field (unlike Sources indices, which use Package).
+type dscControl struct {
+	sourceIndex
+	Source string
+}
+
+// readDsc reads the .dsc file fn. Its files are expected next to it.
+func readDsc(fn string) (sourceIndex, error) {
+	var d dscControl
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return d.sourceIndex, err
+	}
+	if err := control.Unmarshal(&d, bytes.NewReader(b)); err != nil {
+		return d.sourceIndex, fmt.Errorf("%s: %v", fn, err)
+	}
+	if d.Source == "" {
+		return d.sourceIndex, fmt.Errorf("%s: missing Source field", fn)
+	}
+	src := d.sourceIndex
+	src.Package = d.Source
+	abs, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return src, err
+	}
+	src.Directory = abs
+	return src, nil
+}
+
+// readSourcesFile reads the (possibly compressed) Sources index fn of a local
+// mirror. The mirror root, which the Directory fields are relative to, is the
+// closest parent directory of fn in which they exist.
+func readSourcesFile(fn string) ([]sourceIndex, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	srcs, err := loadSources(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if len(srcs) == 0 {
+		return nil, nil
+	}
+	root, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(root, srcs[0].Directory)); err == nil {
+			break
+		}
+		if root == filepath.Dir(root) {
+			return nil, fmt.Errorf("%s: mirror root not found: no parent directory contains %s", fn, srcs[0].Directory)
+		}
+		root = filepath.Dir(root)
+	}
+	for idx := range srcs {
+		srcs[idx].Directory = filepath.Join(root, srcs[idx].Directory)
+	}
+	return srcs, nil
+}
+
+// batchSources reads the source packages specified by args: .dsc files,
+// directories (searched for .dsc files, e.g. a local pool) and Sources files.
+func batchSources(args []string) ([]sourceIndex, error) {
+	var srcs []sourceIndex
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case fi.IsDir():
+			var layer []sourceIndex
+			err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() && strings.HasSuffix(path, ".dsc") {
+					src, err := readDsc(path)
+					if err != nil {
+						return err
+					}
+					if dependsOnGo(&src) {
+						layer = append(layer, src)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			srcs = mergeSources(srcs, layer)
+		case strings.HasSuffix(arg, ".dsc"):
+			src, err := readDsc(arg)
+			if err != nil {
+				return nil, err
+			}
+			srcs = mergeSources(srcs, []sourceIndex{src})
+		default:
+			layer, err := readSourcesFile(arg)
+			if err != nil {
+				return nil, err
+			}
+			srcs = mergeSources(srcs, layer)
+		}
+	}
+	return srcs, nil
+}
+
+// batch implements the batch subcommand, which layers local source packages
+// (e.g. pending uploads) onto an existing snapshot, creating a new snapshot.
+func batch(args []string) error {
+	fset := flag.NewFlagSet("batch", flag.ExitOnError)
+	var (
+		base = fset.String("base",
+			"",
+			"Snapshot (directory or timestamp) to layer the source packages onto. Defaults to the published src snapshot, or the latest src-<timestamp> snapshot.")
+
+		output = fset.String("output",
+			"",
+			"Directory to create the new snapshot in (atomically). Defaults to batch-<current UNIX timestamp>.")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath batch [flags] <.dsc file, pool directory or Sources file>…\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	baseDir, err := resolveBase(*base)
+	if err != nil {
+		return err
+	}
+	dest := *output
+	if dest == "" {
+		dest = fmt.Sprintf("batch-%d", time.Now().Unix())
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if _, err := loadPolicy(*policyPath); err != nil {
+		return err
+	}
+	srcs, err := batchSources(fset.Args())
+	if err != nil {
+		return err
+	}
+	g := &archive.Downloader{
+		MaxTransientRetries: 3,
+		LocalMirror:         "/", // Directory fields are absolute
+	}
+	fn := func(tempdir string, src *sourceIndex) (*packageManifest, error) {
+		return process(g, tempdir, src.importPath(), src, nil)
+	}
+	if err := layerSnapshot(baseDir, dest, "local source packages", srcs, fn); err != nil {
+		return err
+	}
+	fmt.Println(dest)
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writeDsc writes a 3.0 (native) source package with the Go files files
+// (name → contents) to dir, and returns the path of its .dsc file.
+func writeDsc(t *testing.T, dir, pkg, version, importPath string, files map[string]string) string {
+	t.Helper()
+	top := pkg + "-" + version + "/"
+	entries := []tarEntry{
+		{name: top},
+		{name: top + "debian/changelog", body: fmt.Sprintf("%s (%s) unstable; urgency=medium\n", pkg, version)},
+	}
+	for name, body := range files {
+		entries = append(entries, tarEntry{name: top + name, body: body})
+	}
+	b, err := ioutil.ReadFile(writeTarball(t, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := pkg + "_" + version + ".tar.gz"
+	if err := ioutil.WriteFile(filepath.Join(dir, tarball), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dsc := fmt.Sprintf(`Format: 3.0 (native)
+Source: %s
+Binary: %s-dev
+Architecture: all
+Version: %s
+Build-Depends: debhelper-compat (= 13), dh-golang, golang-any
+Go-Import-Path: %s
+Checksums-Sha256:
+ %x %d %s
+Files:
+ 00000000000000000000000000000000 %d %s
+`, pkg, pkg, version, importPath, sha256.Sum256(b), len(b), tarball, len(b), tarball)
+	fn := filepath.Join(dir, pkg+"_"+version+".dsc")
+	if err := ioutil.WriteFile(fn, []byte(dsc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestReadDsc(t *testing.T) {
+	dir := t.TempDir()
+	fn := writeDsc(t, dir, "golang-example-foo", "1.0", "example.com/foo", nil)
+	src, err := readDsc(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := src.Package, "golang-example-foo"; got != want {
+		t.Errorf("unexpected Package: got %q, want %q", got, want)
+	}
+	if got, want := src.importPath(), "example.com/foo"; got != want {
+		t.Errorf("unexpected import path: got %q, want %q", got, want)
+	}
+	if got, want := src.Directory, dir; got != want {
+		t.Errorf("unexpected Directory: got %q, want %q", got, want)
+	}
+
+	missing := filepath.Join(dir, "missing.dsc")
+	if err := ioutil.WriteFile(missing, []byte("Format: 3.0 (native)\nVersion: 1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDsc(missing); err == nil {
+		t.Errorf("readDsc(%s) unexpectedly succeeded without Source field", missing)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	pool := filepath.Join(dir, "pool")
+	base := filepath.Join(dir, "base")
+	for _, d := range []string{pool, base} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foo := writeDsc(t, pool, "golang-example-foo", "1.0", "example.com/foo", map[string]string{
+		"foo.go": "package foo\n",
+	})
+	bar := writeDsc(t, pool, "golang-example-bar", "2.0", "example.com/bar", map[string]string{
+		"bar.go": "package bar\n",
+	})
+	output := filepath.Join(dir, "batch")
+	if err := batch([]string{"-base=" + base, "-output=" + output, foo, bar}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readManifest(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pm := range m.Packages {
+		got = append(got, fmt.Sprintf("%s %s %s %s", pm.Package, pm.Version, pm.Dir, pm.Status))
+	}
+	sort.Strings(got)
+	want := []string{
+		"golang-example-bar 2.0 example.com/bar ok",
+		"golang-example-foo 1.0 example.com/foo ok",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected manifest packages: got %q, want %q", got, want)
+	}
+	for _, fn := range []string{"example.com/foo/foo.go", "example.com/bar/bar.go"} {
+		if _, err := ioutil.ReadFile(filepath.Join(output, fn)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBatchPolicyIgnored(t *testing.T) {
+	dir := t.TempDir()
+	pool := filepath.Join(dir, "pool")
+	empty := filepath.Join(dir, "empty")
+	for _, d := range []string{pool, empty} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foo := writeDsc(t, pool, "golang-example-foo", "1.0", "example.com/foo", map[string]string{
+		"foo.go": "package foo\n",
+	})
+	bar := writeDsc(t, pool, "golang-example-bar", "2.0", "example.com/bar", map[string]string{
+		"bar.go": "package bar\n",
+	})
+	base := filepath.Join(dir, "base")
+	if err := batch([]string{"-base=" + empty, "-output=" + base, foo, bar}); err != nil {
+		t.Fatal(err)
+	}
+
+	// golang-example-bar is part of the base snapshot, golang-example-baz is
+	// a local source package:
+	pol := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(pol, []byte(`{
+  "version": 1,
+  "ignored": {
+    "golang-example-bar": {"reason": "test"},
+    "golang-example-baz": {"reason": "test"}
+  }
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, policyPath, pol)
+	t.Cleanup(func() { loadPolicy("") })
+	baz := writeDsc(t, pool, "golang-example-baz", "3.0", "example.com/baz", map[string]string{
+		"baz.go": "package baz\n",
+	})
+	qux := writeDsc(t, pool, "golang-example-qux", "4.0", "example.com/qux", map[string]string{
+		"qux.go": "package qux\n",
+	})
+	output := filepath.Join(dir, "batch")
+	if err := batch([]string{"-base=" + base, "-output=" + output, baz, qux}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readManifest(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pm := range m.Packages {
+		got = append(got, fmt.Sprintf("%s %s %s", pm.Package, pm.Status, pm.Category))
+	}
+	sort.Strings(got)
+	want := []string{
+		"golang-example-bar skipped ignored",
+		"golang-example-baz skipped ignored",
+		"golang-example-foo ok ",
+		"golang-example-qux ok ",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected manifest packages: got %q, want %q", got, want)
+	}
+	for fn, wantExist := range map[string]bool{
+		"example.com/foo/foo.go": true,
+		"example.com/qux/qux.go": true,
+		"example.com/bar":        false,
+		"example.com/baz":        false,
+	} {
+		_, err := os.Stat(filepath.Join(output, fn))
+		if exists := err == nil; exists != wantExist {
+			t.Errorf("%s: exists = %v, want %v", fn, exists, wantExist)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxOutput limits how much output of each step is kept (the end is kept, as
+// that is where the go tool prints failures).
+const maxOutput = 64 << 10
+
+// Status values of checkStep and checkResult.
+const (
+	checkPass    = "pass"
+	checkFail    = "fail"
+	checkTimeout = "timeout"
+)
+
+// checkStep is the result of running one go tool command.
+type checkStep struct {
+	Name     string        `json:"name"` // build or test
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output,omitempty"` // only for failures
+}
+
+// checkResult is the result of checking one source package.
+type checkResult struct {
+	Package    string       `json:"package"`
+	Version    string       `json:"version"`
+	ImportPath string       `json:"import_path"`
+	Status     string       `json:"status"` // status of the first failing step, or pass
+	Steps      []*checkStep `json:"steps"`
+}
+
+// checker builds and tests package trees of a workspace in GOPATH mode.
+type checker struct {
+	goroot   string // empty for the go tool in $PATH
+	gopath   string // contains src, a symlink to the workspace
+	timeout  time.Duration
+	parallel int
+	tests    bool
+}
+
+func (c *checker) goTool() string {
+	if c.goroot == "" {
+		return "go"
+	}
+	return filepath.Join(c.goroot, "bin", "go")
+}
+
+func (c *checker) env() []string {
+	env := append(os.Environ(),
+		"GOPATH="+c.gopath,
+		"GO111MODULE=off",
+		"GOFLAGS=",
+		"GOPROXY=off")
+	if c.goroot != "" {
+		env = append(env, "GOROOT="+c.goroot)
+	}
+	return env
+}
+
+func (c *checker) run(name string, args ...string) *checkStep {
+	start := time.Now()
+	var out bytes.Buffer
+	cmd := exec.Command(c.goTool(), args...)
+	cmd.Dir = filepath.Join(c.gopath, "src")
+	cmd.Env = c.env()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Run in a separate process group, so that on timeout, test binaries
+	// started by the go tool are killed as well.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	timedOut := false
+	if err == nil {
+		var mu sync.Mutex
+		timer := time.AfterFunc(c.timeout, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			timedOut = true
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		err = cmd.Wait()
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	step := &checkStep{
+		Name:     name,
+		Status:   checkPass,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		step.Status = checkFail
+		if timedOut {
+			step.Status = checkTimeout
+			fmt.Fprintf(&out, "\n%s timed out after %v\n", name, c.timeout)
+		} else if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintf(&out, "\n%v\n", err)
+		}
+		b := out.Bytes()
+		if len(b) > maxOutput {
+			b = append([]byte("[…]\n"), b[len(b)-maxOutput:]...)
+		}
+		step.Output = string(b)
+	}
+	return step
+}
+
+// goPackages returns the import paths of the Go packages within the package
+// tree importPath, like importPath/... does, but excluding nested package trees
+// of other source packages (which are checked on their own).
+func (c *checker) goPackages(importPath string) ([]string, error) {
+	src := filepath.Join(c.gopath, "src")
+	dir := filepath.Join(src, importPath)
+	seen := make(map[string]bool)
+	var pkgs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == dir {
+				return nil
+			}
+			switch name := info.Name(); {
+			case path == filepath.Join(dir, "debian"),
+				name == "testdata" || name == "vendor",
+				strings.HasPrefix(name, "."), strings.HasPrefix(name, "_"):
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+				return filepath.SkipDir // another source package
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		rel, err := filepath.Rel(src, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if pkg := filepath.ToSlash(rel); !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+		return nil
+	})
+	return pkgs, err
+}
+
+// check builds (and tests, unless disabled) the package tree of one source
+// package. Testing is skipped if building fails.
+func (c *checker) check(res *checkResult) {
+	res.Status = checkPass
+	pkgs, err := c.goPackages(res.ImportPath)
+	if err != nil {
+		res.Status = checkFail
+		res.Steps = append(res.Steps, &checkStep{
+			Name:   "build",
+			Status: checkFail,
+			Output: err.Error(),
+		})
+		return
+	}
+	if len(pkgs) == 0 {
+		return // nothing to build, e.g. only nested package trees
+	}
+	steps := [][]string{append([]string{"build", "build"}, pkgs...)}
+	if c.tests {
+		steps = append(steps, append([]string{"test", "test"}, pkgs...))
+	}
+	for _, args := range steps {
+		step := c.run(args[0], args[1:]...)
+		res.Steps = append(res.Steps, step)
+		if step.Status != checkPass {
+			res.Status = step.Status
+			return
+		}
+	}
+}
+
+// checkAll checks all package trees of the workspace in dir (or only those
+// whose source package or import path is contained in only, if non-empty).
+func (c *checker) checkAll(dir string, only map[string]bool) ([]*checkResult, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	gopath, err := ioutil.TempDir("", "pgt-gopath-check-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(gopath)
+	if err := os.Symlink(abs, filepath.Join(gopath, "src")); err != nil {
+		return nil, err
+	}
+	c.gopath = gopath
+
+	trees, err := packageTrees(dir)
+	if err != nil {
+		return nil, err
+	}
+	var results []*checkResult
+	for _, tree := range trees {
+		pkg, v, err := changelogEntry(tree.Dir)
+		if err != nil {
+			log.Printf("%s: %v", tree.ImportPath, err)
+			continue
+		}
+		if len(only) > 0 && !only[pkg] && !only[tree.ImportPath] {
+			continue
+		}
+		results = append(results, &checkResult{
+			Package:    pkg,
+			Version:    v.String(),
+			ImportPath: tree.ImportPath,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Package < results[j].Package })
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, c.parallel)
+	for _, res := range results {
+		res := res // copy
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			c.check(res)
+			if res.Status != checkPass {
+				log.Printf("src:%s: %s", res.Package, strings.ToUpper(res.Status))
+			}
+		}()
+	}
+	wg.Wait()
+	log.Printf("checked %d source packages in %v", len(results), time.Since(start))
+	return results, nil
+}
+
+// JUnit XML, as understood by most CI systems: one test suite per source
+// package, one test case per step.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+func writeJUnit(filename string, results []*checkResult) error {
+	var suites junitTestSuites
+	for _, res := range results {
+		suite := junitTestSuite{Name: res.Package}
+		for _, step := range res.Steps {
+			tc := junitTestCase{
+				Name:      step.Name,
+				Classname: res.ImportPath,
+				Time:      step.Duration.Seconds(),
+			}
+			if step.Status != checkPass {
+				tc.Failure = &junitFailure{
+					Message: fmt.Sprintf("go %s %s: %s", step.Name, res.ImportPath, step.Status),
+					Output:  step.Output,
+				}
+				suite.Failures++
+			}
+			suite.Tests++
+			suite.Time += tc.Time
+			suite.Cases = append(suite.Cases, tc)
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+	b, err := xml.MarshalIndent(&suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
+
+var checkReportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pgt-gopath check: {{ .Failed }} of {{ len .Results }} source packages failed</title>
+<style>
+.pass { color: green; }
+.fail, .timeout { color: red; }
+pre { background: #eee; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>{{ .Failed }} of {{ len .Results }} source packages failed</h1>
+{{ range .Results }}{{ if ne .Status "pass" }}
+<h2 id="{{ .Package }}">src:{{ .Package }} {{ .Version }} <span class="{{ .Status }}">{{ .Status }}</span></h2>
+{{ range .Steps }}{{ if ne .Status "pass" }}
+<details open>
+<summary>{{ .Name }}: <span class="{{ .Status }}">{{ .Status }}</span> ({{ .Duration }})</summary>
+<pre>{{ .Output }}</pre>
+</details>
+{{ end }}{{ end }}{{ end }}{{ end }}
+<h1>All source packages</h1>
+<table>
+<tr><th>source package</th><th>version</th><th>import path</th><th>status</th></tr>
+{{ range .Results }}
+<tr><td>{{ .Package }}</td><td>{{ .Version }}</td><td>{{ .ImportPath }}</td><td class="{{ .Status }}">{{ .Status }}</td></tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+func writeHTML(filename string, results []*checkResult) error {
+	var failed int
+	for _, res := range results {
+		if res.Status != checkPass {
+			failed++
+		}
+	}
+	var buf bytes.Buffer
+	if err := checkReportTmpl.Execute(&buf, struct {
+		Results []*checkResult
+		Failed  int
+	}{results, failed}); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+func writeJSON(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// check implements the check subcommand, which builds and tests all source
+// packages of a workspace.
+func check(args []string) error {
+	fset := flag.NewFlagSet("check", flag.ExitOnError)
+	var (
+		dir = fset.String("dir",
+			"src",
+			"Workspace src directory (e.g. src-<timestamp>) to check")
+
+		goroot = fset.String("goroot",
+			"",
+			"GOROOT of the Go toolchain to use. Defaults to the go tool in $PATH.")
+
+		parallel = fset.Int("parallel",
+			4,
+			"Number of source packages to check concurrently (each go tool invocation is parallel, too)")
+
+		timeout = fset.Duration("timeout",
+			10*time.Minute,
+			"Timeout for building and for testing each source package")
+
+		tests = fset.Bool("tests",
+			true,
+			"Run go test in addition to go build")
+
+		jsonPath = fset.String("json",
+			"",
+			"Path of a file to write the results to, in JSON")
+
+		junitPath = fset.String("junit",
+			"",
+			"Path of a file to write a JUnit XML report to")
+
+		htmlPath = fset.String("html",
+			"",
+			"Path of a file to write an HTML report to")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath check [flags] [<source package or import path>…]\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+
+	only := make(map[string]bool)
+	for _, arg := range fset.Args() {
+		only[arg] = true
+	}
+	c := &checker{
+		goroot:   *goroot,
+		timeout:  *timeout,
+		parallel: *parallel,
+		tests:    *tests,
+	}
+	results, err := c.checkAll(*dir, only)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, res := range results {
+		if res.Status != checkPass {
+			failed++
+			fmt.Printf("%-7s src:%s %s (%s)\n", strings.ToUpper(res.Status), res.Package, res.Version, res.ImportPath)
+		}
+	}
+	if *jsonPath != "" {
+		if err := writeJSON(*jsonPath, results); err != nil {
+			return err
+		}
+	}
+	if *junitPath != "" {
+		if err := writeJUnit(*junitPath, results); err != nil {
+			return err
+		}
+	}
+	if *htmlPath != "" {
+		if err := writeHTML(*htmlPath, results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d source packages failed", failed, len(results))
+	}
+	return nil
+}
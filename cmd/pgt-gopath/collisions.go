@@ -0,0 +1,431 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	collisionPolicy = flag.String("collision_policy",
+		"prefer",
+		"How to resolve source packages claiming the same import path (or shipping files within another package’s import path): prefer (the package listed first in -collision_prefer wins, otherwise the alphabetically first package for identical import paths, or the package dedicated to the nested import path), skip (all colliding packages not listed in -collision_prefer are skipped, except for enclosing packages of nested collisions) or fail (abort unless -collision_prefer resolves every collision)")
+
+	collisionPrefer = flag.String("collision_prefer",
+		"golang-github-spf13-cobra,containerd",
+		"Comma-separated list of source packages which win import path collisions, in order of preference. Aliases (additional Go-Import-Path entries) never win against package trees.")
+
+	collisionReport = flag.String("collision_report",
+		"",
+		"Path of a file to write all detected import path collisions to, in JSON (e.g. for filing bugs)")
+)
+
+// Kinds of collisions.
+const (
+	collisionExact  = "exact"  // multiple source packages declare the same import path
+	collisionNested = "nested" // a source package ships files within the import path of another
+)
+
+// collision describes source packages which claim the same import path.
+type collision struct {
+	ImportPath string   `json:"import_path"`
+	Kind       string   `json:"kind"`
+	Packages   []string `json:"packages"`         // for nested collisions: the enclosing packages (closest first), then the nested package
+	Winner     string   `json:"winner,omitempty"` // empty if all packages were skipped
+}
+
+// collisions collects the collisions of a run, which are detected concurrently.
+type collisions struct {
+	policy string
+	prefer map[string]int // source package → rank, lower wins
+
+	mu   sync.Mutex
+	list []*collision
+	lost map[string][]lostAlias // source package → aliases which were not created
+}
+
+func newCollisions(policy, prefer string) (*collisions, error) {
+	switch policy {
+	case "prefer", "skip", "fail":
+	default:
+		return nil, fmt.Errorf("unknown -collision_policy %q: expected prefer, skip or fail", policy)
+	}
+	c := &collisions{
+		policy: policy,
+		prefer: make(map[string]int),
+		lost:   make(map[string][]lostAlias),
+	}
+	for idx, pkg := range strings.Split(prefer, ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" {
+			c.prefer[pkg] = idx
+		}
+	}
+	return c, nil
+}
+
+// preferred returns the package of pkgs listed first in -collision_prefer, or
+// "" if none of them is listed.
+func (c *collisions) preferred(pkgs []string) string {
+	var winner string
+	for _, pkg := range pkgs {
+		rank, ok := c.prefer[pkg]
+		if !ok {
+			continue
+		}
+		if winner == "" || rank < c.prefer[winner] {
+			winner = pkg
+		}
+	}
+	return winner
+}
+
+// resolve applies the policy to col, setting col.Winner. fallback is the
+// winner of the prefer policy if -collision_prefer does not list any of the
+// colliding packages.
+func (c *collisions) resolve(col *collision, fallback string) error {
+	col.Winner = c.preferred(col.Packages)
+	if col.Winner != "" {
+		return nil
+	}
+	switch c.policy {
+	case "prefer":
+		col.Winner = fallback
+	case "fail":
+		return fmt.Errorf("import path collision: %s claimed by src:%s (see -collision_policy and -collision_prefer)",
+			col.ImportPath, strings.Join(col.Packages, ", src:"))
+	}
+	return nil
+}
+
+// record logs col and adds it to the collision report.
+func (c *collisions) record(col *collision) {
+	if col.Winner == "" {
+		log.Printf("collision (%s): %s claimed by src:%s, skipping all",
+			col.Kind, col.ImportPath, strings.Join(col.Packages, ", src:"))
+	} else {
+		log.Printf("collision (%s): %s claimed by src:%s, src:%s wins",
+			col.Kind, col.ImportPath, strings.Join(col.Packages, ", src:"), col.Winner)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list = append(c.list, col)
+}
+
+// loseAlias records that the alias of the source package pkg was not created,
+// as winner won the collision.
+func (c *collisions) loseAlias(pkg, alias, winner string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lost[pkg] = append(c.lost[pkg], lostAlias{ImportPath: alias, Winner: winner})
+}
+
+// lostAliases returns the aliases of the source package pkg which were not
+// created (see packageManifest).
+func (c *collisions) lostAliases(pkg string) []lostAlias {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lost[pkg]
+}
+
+// exact resolves collisions between source packages declaring the same import
+// path, either as their primary import path or as an alias. It returns the
+// source packages to process (in their original order), the aliases to create
+// for each of them, and manifests of the skipped packages. Packages losing
+// their primary import path are skipped, packages losing an alias only lose
+// the alias (see lostAliases).
+func (c *collisions) exact(srcs []sourceIndex) ([]sourceIndex, map[string][]string, []*packageManifest, error) {
+	byPath := make(map[string][]string) // import path → source packages
+	primary := make(map[string]bool)    // source package + " " + import path
+	for _, src := range srcs {
+		for idx, importPath := range src.importPaths() {
+			byPath[importPath] = append(byPath[importPath], src.Package)
+			if idx == 0 {
+				primary[src.Package+" "+importPath] = true
+			}
+		}
+	}
+	var paths []string
+	for importPath, pkgs := range byPath {
+		if len(pkgs) > 1 {
+			paths = append(paths, importPath)
+		}
+	}
+	sort.Strings(paths)
+	reasons := make(map[string]string) // source package → why it is skipped
+	lost := make(map[string]bool)      // source package + " " + alias
+	for _, importPath := range paths {
+		pkgs := byPath[importPath]
+		sort.Strings(pkgs)
+		col := &collision{
+			ImportPath: importPath,
+			Kind:       collisionExact,
+			Packages:   pkgs,
+		}
+		// Packages whose primary import path it is take precedence over
+		// packages declaring it as an alias.
+		fallback := pkgs[0]
+		for _, pkg := range pkgs {
+			if primary[pkg+" "+importPath] {
+				fallback = pkg
+				break
+			}
+		}
+		if err := c.resolve(col, fallback); err != nil {
+			return nil, nil, nil, err
+		}
+		c.record(col)
+		for _, pkg := range pkgs {
+			if pkg == col.Winner {
+				continue
+			}
+			if !primary[pkg+" "+importPath] {
+				lost[pkg+" "+importPath] = true
+				c.loseAlias(pkg, importPath, col.Winner)
+				continue
+			}
+			if col.Winner == "" {
+				reasons[pkg] = fmt.Sprintf("import path collision: %s is claimed by src:%s", importPath, strings.Join(pkgs, ", src:"))
+			} else {
+				reasons[pkg] = fmt.Sprintf("import path collision: %s is provided by src:%s", importPath, col.Winner)
+			}
+		}
+	}
+	var (
+		remaining []sourceIndex
+		skipped   []*packageManifest
+	)
+	aliases := make(map[string][]string)
+	for _, src := range srcs {
+		if reason, ok := reasons[src.Package]; ok {
+			skipped = append(skipped, newPackageManifest(&src).skip(categoryCollision, reason))
+			continue
+		}
+		remaining = append(remaining, src)
+		for _, alias := range src.importPaths()[1:] {
+			if !lost[src.Package+" "+alias] {
+				aliases[src.Package] = append(aliases[src.Package], alias)
+			}
+		}
+	}
+	return remaining, aliases, skipped, nil
+}
+
+// enclosing returns the import paths of byPath which are parents of
+// importPath (closest first), i.e. whose package trees contain the package tree
+// of importPath.
+func enclosing(importPath string, byPath map[string]string) []string {
+	var parents []string
+	for p := importPath; strings.Contains(p, "/"); {
+		p = p[:strings.LastIndex(p, "/")]
+		if _, ok := byPath[p]; ok {
+			parents = append(parents, p)
+		}
+	}
+	return parents
+}
+
+// shipsFiles returns whether dir contains anything but directories, i.e.
+// whether an enclosing package tree shipped files within dir. Nested package
+// trees of other source packages (e.g. kept from the base snapshot, see
+// layerSnapshot) are not looked at.
+func shipsFiles(dir string) (bool, error) {
+	var found bool
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			found = true
+			return filepath.SkipDir // no need to look at the remaining files
+		}
+		if path != dir {
+			if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+				return filepath.SkipDir // another source package
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// removeShipped removes the files shipped within dir by enclosing package
+// trees, keeping nested package trees of other source packages (see
+// shipsFiles). Symlinks (e.g. those created by createLinks) are removed, but
+// never followed, so that nothing outside of dir is removed.
+func removeShipped(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.Remove(dir)
+	}
+	fis, err := ioutil.ReadDir(dir) // Lstat-based
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		if !fi.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if isPackageTree(path) {
+			continue // another source package
+		}
+		if err := removeShipped(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPackageTree returns whether the directory dir is a package tree, without
+// following symlinks within dir.
+func isPackageTree(dir string) bool {
+	fi, err := os.Lstat(filepath.Join(dir, "debian"))
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	fi, err = os.Lstat(filepath.Join(dir, "debian", ".hashes"))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// nested resolves a collision between the source package pkg, whose package
+// tree is at dir, and the source packages of the enclosing import paths
+// (closest first), which must have been processed already. It returns whether
+// pkg should be processed. If so, files which were shipped within dir by the
+// enclosing packages have been removed.
+//
+// Note that with -incremental, reused enclosing package trees do not contain
+// the nested package trees, so their collisions are only detected when the
+// enclosing package is unpacked again.
+func (c *collisions) nested(importPath, dir, pkg string, outer []string) (bool, error) {
+	found, err := shipsFiles(dir)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return true, nil
+	}
+	col := &collision{
+		ImportPath: importPath,
+		Kind:       collisionNested,
+		Packages:   append(append([]string(nil), outer...), pkg),
+	}
+	if err := c.resolve(col, pkg); err != nil {
+		return false, err
+	}
+	if col.Winner == "" {
+		col.Winner = outer[0] // already unpacked, so only pkg can be skipped
+	}
+	c.record(col)
+	if col.Winner != pkg {
+		return false, nil
+	}
+	return true, removeShipped(dir)
+}
+
+// createAliases creates symlinks to the package tree of the source package pkg
+// (at its primary import path importPath within dir) for each of its aliases.
+// Aliases within the package tree of another source package, or colliding with
+// files shipped by one, are recorded as nested collisions and not created: the
+// package tree always wins. byPath maps the primary import paths of all source
+// packages to their names. It returns the created aliases.
+func (c *collisions) createAliases(dir, pkg, importPath string, aliases []string, byPath map[string]string) ([]string, error) {
+	var created []string
+	for _, alias := range aliases {
+		dest := filepath.Join(dir, alias)
+		var owners []string // enclosing packages (closest first), then nested ones
+		for _, p := range enclosing(alias, byPath) {
+			owners = append(owners, byPath[p])
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			resolved, err := filepath.EvalSymlinks(dest)
+			tree, terr := filepath.EvalSymlinks(filepath.Join(dir, importPath))
+			if err == nil && terr == nil && resolved == tree {
+				created = append(created, alias) // e.g. as per debian/links
+				continue
+			}
+			var nested []string
+			for p, owner := range byPath {
+				if strings.HasPrefix(p, alias+"/") {
+					nested = append(nested, owner)
+				}
+			}
+			sort.Strings(nested)
+			owners = append(owners, nested...)
+			if len(owners) == 0 {
+				owners = []string{pkg} // e.g. a different target as per debian/links
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(owners) > 0 {
+			c.loseAlias(pkg, alias, owners[0])
+			c.record(&collision{
+				ImportPath: alias,
+				Kind:       collisionNested,
+				Packages:   append(owners, pkg),
+				Winner:     owners[0],
+			})
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+		target, err := filepath.Rel(filepath.Dir(dest), filepath.Join(dir, importPath))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return nil, err
+		}
+		created = append(created, alias)
+	}
+	return created, nil
+}
+
+// checkNested detects and resolves collisions between src and the source
+// packages of the enclosing import paths of byPath (see nested), whose package
+// trees within tempdir must be complete. It returns the manifest of src if src
+// is skipped, or nil if src should be processed.
+func (c *collisions) checkNested(src *sourceIndex, tempdir string, byPath map[string]string) (*packageManifest, error) {
+	parents := enclosing(src.importPath(), byPath)
+	if len(parents) == 0 {
+		return nil, nil
+	}
+	outer := make([]string, len(parents))
+	for idx, p := range parents {
+		outer[idx] = byPath[p]
+	}
+	ok, err := c.nested(src.importPath(), filepath.Join(tempdir, src.importPath()), src.Package, outer)
+	if err != nil || ok {
+		return nil, err
+	}
+	return newPackageManifest(src).skip(categoryCollision,
+		fmt.Sprintf("import path collision: %s is shipped by src:%s", src.importPath(), strings.Join(outer, ", src:"))), nil
+}
+
+// write writes the collisions to path, in JSON.
+func (c *collisions) write(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sort.Slice(c.list, func(i, j int) bool { return c.list[i].ImportPath < c.list[j].ImportPath })
+	list := c.list
+	if list == nil {
+		list = []*collision{}
+	}
+	return writeJSON(path, list)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveShipped(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{
+		"outside/keep.go",
+		"outside/debian/.hashes",
+		"tree/shipped.go",
+		"tree/sub/shipped.go",
+		"tree/nested/debian/.hashes", // another source package
+		"tree/nested/nested.go",
+		"tree/fake/fake.go",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(fn))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"tree/link":        "../outside",
+		"tree/fake/debian": "../../outside/debian", // does not make fake a package tree
+		"alias":            "outside",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removeShipped(filepath.Join(dir, "tree")); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeShipped(filepath.Join(dir, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"outside/keep.go":            "",
+		"outside/debian/.hashes":     "",
+		"tree/nested/debian/.hashes": "",
+		"tree/nested/nested.go":      "",
+	}
+	if got := treeContents(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected contents: got %q, want %q", got, want)
+	}
+}
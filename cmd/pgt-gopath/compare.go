@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// comparison is a source package whose check status differs between two Go
+// toolchains.
+type comparison struct {
+	Package    string `json:"package"`
+	Version    string `json:"version"`
+	ImportPath string `json:"import_path"`
+	Change     string `json:"change"` // regression (passes with old, fails with new) or fixed
+	OldStatus  string `json:"old_status"`
+	NewStatus  string `json:"new_status"`
+	OldOutput  string `json:"old_output,omitempty"`
+	NewOutput  string `json:"new_output,omitempty"`
+}
+
+// failureOutput returns the output of the first failing step of res.
+func failureOutput(res *checkResult) string {
+	for _, step := range res.Steps {
+		if step.Status != checkPass {
+			return fmt.Sprintf("go %s: %s\n%s", step.Name, step.Status, step.Output)
+		}
+	}
+	return ""
+}
+
+// compareResults returns the source packages whose status differs between
+// the results of the old and new toolchain.
+func compareResults(before, after []*checkResult) []*comparison {
+	byName := make(map[string]*checkResult, len(before))
+	for _, res := range before {
+		byName[res.Package] = res
+	}
+	var comparisons []*comparison
+	for _, n := range after { // sorted by package
+		o, ok := byName[n.Package]
+		if !ok || (o.Status == checkPass) == (n.Status == checkPass) {
+			continue
+		}
+		change := "regression"
+		if n.Status == checkPass {
+			change = "fixed"
+		}
+		comparisons = append(comparisons, &comparison{
+			Package:    n.Package,
+			Version:    n.Version,
+			ImportPath: n.ImportPath,
+			Change:     change,
+			OldStatus:  o.Status,
+			NewStatus:  n.Status,
+			OldOutput:  failureOutput(o),
+			NewOutput:  failureOutput(n),
+		})
+	}
+	return comparisons
+}
+
+var compareReportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pgt-gopath compare: {{ .Old }} vs. {{ .New }}</title>
+<style>
+table { table-layout: fixed; width: 100%; }
+td { vertical-align: top; }
+.pass { color: green; }
+.fail, .timeout { color: red; }
+pre { background: #eee; overflow-x: auto; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{ len .Comparisons }} source packages behave differently</h1>
+<table>
+<tr><th>old: {{ .Old }}</th><th>new: {{ .New }}</th></tr>
+{{ range .Comparisons }}
+<tr><th colspan="2" id="{{ .Package }}">src:{{ .Package }} {{ .Version }}: {{ .Change }}</th></tr>
+<tr>
+<td><span class="{{ .OldStatus }}">{{ .OldStatus }}</span><pre>{{ .OldOutput }}</pre></td>
+<td><span class="{{ .NewStatus }}">{{ .NewStatus }}</span><pre>{{ .NewOutput }}</pre></td>
+</tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// compare implements the compare subcommand, which checks the workspace with
+// two Go toolchains and reports source packages which pass with one, but fail
+// with the other (e.g. to find regressions in changes to the standard
+// library).
+func compare(args []string) error {
+	fset := flag.NewFlagSet("compare", flag.ExitOnError)
+	var (
+		dir = fset.String("dir",
+			"src",
+			"Workspace src directory (e.g. src-<timestamp>) to check")
+
+		oldGoroot = fset.String("old_goroot",
+			"",
+			"GOROOT of the baseline Go toolchain, e.g. /usr/lib/go. Defaults to the go tool in $PATH.")
+
+		newGoroot = fset.String("new_goroot",
+			"",
+			"GOROOT of the Go toolchain to compare against the baseline, e.g. a locally built $HOME/go")
+
+		parallel = fset.Int("parallel",
+			4,
+			"Number of source packages to check concurrently (each go tool invocation is parallel, too)")
+
+		timeout = fset.Duration("timeout",
+			10*time.Minute,
+			"Timeout for building and for testing each source package")
+
+		tests = fset.Bool("tests",
+			true,
+			"Run go test in addition to go build")
+
+		jsonPath = fset.String("json",
+			"",
+			"Path of a file to write the differences to, in JSON")
+
+		htmlPath = fset.String("html",
+			"",
+			"Path of a file to write an HTML report with side-by-side output to")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath compare -new_goroot=<dir> [flags] [<source package or import path>…]\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *newGoroot == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	only := make(map[string]bool)
+	for _, arg := range fset.Args() {
+		only[arg] = true
+	}
+	// The toolchains are used one after the other, so that they do not compete
+	// for resources (which could cause spurious timeouts).
+	var results [2][]*checkResult
+	for idx, goroot := range []string{*oldGoroot, *newGoroot} {
+		c := &checker{
+			goroot:   goroot,
+			timeout:  *timeout,
+			parallel: *parallel,
+			tests:    *tests,
+		}
+		res, err := c.checkAll(*dir, only)
+		if err != nil {
+			return err
+		}
+		results[idx] = res
+	}
+
+	oldName, newName := *oldGoroot, *newGoroot
+	if oldName == "" {
+		oldName = "go in $PATH"
+	}
+	comparisons := compareResults(results[0], results[1])
+	var regressions int
+	for _, c := range comparisons {
+		if c.Change == "regression" {
+			regressions++
+		}
+		fmt.Printf("%-10s src:%s %s (%s with %s, %s with %s)\n",
+			c.Change, c.Package, c.Version, c.OldStatus, oldName, c.NewStatus, newName)
+	}
+	if *jsonPath != "" {
+		if err := writeJSON(*jsonPath, comparisons); err != nil {
+			return err
+		}
+	}
+	if *htmlPath != "" {
+		var buf bytes.Buffer
+		if err := compareReportTmpl.Execute(&buf, struct {
+			Old, New    string
+			Comparisons []*comparison
+		}{oldName, newName, comparisons}); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*htmlPath, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d source packages regressed with %s", regressions, newName)
+	}
+	return nil
+}
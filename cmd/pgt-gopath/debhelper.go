@@ -23,15 +23,18 @@ func dhFilesForPackage(dir, typ string) ([]string, error) {
 	return names, nil
 }
 
-func createLinks(destdir, dir string) error {
+// createLinks creates the symlinks within usr/share/gocode/src which the
+// debian/links files of the package tree in dir specify, relative to destdir.
+func createLinks(destdir, dir string) ([]symlink, error) {
 	names, err := dhFilesForPackage(dir, "links")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var created []symlink
 	for _, name := range names {
 		links, err := ioutil.ReadFile(filepath.Join(dir, "debian", name))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		for _, line := range strings.Split(strings.TrimSpace(string(links)), "\n") {
 			if !strings.HasPrefix(line, "usr/share/gocode/src") {
@@ -45,18 +48,22 @@ func createLinks(destdir, dir string) error {
 			oldname := filepath.Join(destdir, strings.TrimPrefix(parts[0], "usr/share/gocode/src"))
 			newname := filepath.Join(destdir, strings.TrimPrefix(parts[1], "usr/share/gocode/src"))
 			if err := os.MkdirAll(filepath.Dir(newname), 0755); err != nil {
-				return err
+				return nil, err
 			}
 			rel, err := filepath.Rel(filepath.Dir(newname), oldname)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if err := os.Symlink(rel, newname); err != nil && !os.IsExist(err) {
-				return err
+				return nil, err
 			}
+			created = append(created, symlink{
+				Name:   strings.TrimPrefix(parts[1], "usr/share/gocode/src/"),
+				Target: strings.TrimPrefix(parts[0], "usr/share/gocode/src/"),
+			})
 		}
 	}
-	return nil
+	return created, nil
 }
 
 func cleanFiles(dir string) error {
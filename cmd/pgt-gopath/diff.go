@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/version"
+)
+
+// snapshotPackage is a source package contained in a snapshot.
+type snapshotPackage struct {
+	Package string
+	Version string
+	Dir     string // absolute, or relative to the working directory
+	Hashes  string // in debian/.hashes format
+}
+
+// hashesOf returns the tarball hashes of pm in debian/.hashes format.
+func hashesOf(pm *packageManifest) string {
+	var lines []string
+	for _, t := range pm.Tarballs {
+		lines = append(lines, t.Name+"="+t.Hash[strings.Index(t.Hash, ":")+1:])
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// snapshotPackages returns the source packages contained in the snapshot in
+// dir, keyed by name. They are read from the snapshot’s manifest.json file if
+// present, or from the debian/.hashes files of its package trees otherwise
+// (e.g. for snapshots created by older versions of pgt-gopath).
+func snapshotPackages(dir string) (map[string]*snapshotPackage, error) {
+	pkgs := make(map[string]*snapshotPackage)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err == nil {
+		var m manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Join(dir, "manifest.json"), err)
+		}
+		for _, pm := range m.Packages {
+			if pm.Status != statusOK {
+				continue
+			}
+			pkgs[pm.Package] = &snapshotPackage{
+				Package: pm.Package,
+				Version: pm.Version,
+				Dir:     filepath.Join(dir, filepath.FromSlash(pm.Dir)),
+				Hashes:  hashesOf(pm),
+			}
+		}
+		return pkgs, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	trees, err := packageTrees(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, tree := range trees {
+		pkg, v, err := changelogEntry(tree.Dir)
+		if err != nil {
+			log.Printf("%s: %v", tree.ImportPath, err)
+			continue
+		}
+		hashes, err := ioutil.ReadFile(filepath.Join(tree.Dir, "debian", ".hashes"))
+		if err != nil {
+			return nil, err
+		}
+		pkgs[pkg] = &snapshotPackage{
+			Package: pkg,
+			Version: v.String(),
+			Dir:     tree.Dir,
+			Hashes:  string(hashes),
+		}
+	}
+	return pkgs, nil
+}
+
+// packageChange describes how a source package differs between two snapshots.
+type packageChange struct {
+	Package    string `json:"package"`
+	Change     string `json:"change"` // added, removed, upgraded, downgraded or changed (same version, different tarballs)
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+// diffPackages compares the source packages of two snapshots.
+func diffPackages(before, after map[string]*snapshotPackage) []packageChange {
+	var changes []packageChange
+	for name, o := range before {
+		n, ok := after[name]
+		if !ok {
+			changes = append(changes, packageChange{Package: name, Change: "removed", OldVersion: o.Version})
+			continue
+		}
+		if o.Version == n.Version && o.Hashes == n.Hashes {
+			continue
+		}
+		change := "changed"
+		if o.Version != n.Version {
+			change = "upgraded"
+			ov, oerr := version.Parse(o.Version)
+			nv, nerr := version.Parse(n.Version)
+			if oerr == nil && nerr == nil && version.Compare(nv, ov) < 0 {
+				change = "downgraded"
+			}
+		}
+		changes = append(changes, packageChange{Package: name, Change: change, OldVersion: o.Version, NewVersion: n.Version})
+	}
+	for name, n := range after {
+		if _, ok := before[name]; !ok {
+			changes = append(changes, packageChange{Package: name, Change: "added", NewVersion: n.Version})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Package < changes[j].Package })
+	return changes
+}
+
+// resolveSnapshot accepts snapshot directories as well as timestamps of
+// src-<timestamp> directories in the working directory.
+func resolveSnapshot(arg string) (string, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, nil
+	}
+	if _, err := os.Stat("src-" + arg); err == nil {
+		return "src-" + arg, nil
+	}
+	return "", fmt.Errorf("snapshot %q not found", arg)
+}
+
+// diff implements the diff subcommand, which prints the changes between two
+// snapshots, or a file-level diff of one package with -package.
+func diff(args []string) error {
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	var (
+		format = fset.String("format",
+			"text",
+			"Output format: text or json")
+
+		pkg = fset.String("package",
+			"",
+			"If non-empty, print a unified diff (see diff(1)) of the files of this source package instead")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath diff [flags] <old snapshot> <new snapshot>\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown -format %q: expected text or json", *format)
+	}
+	oldDir, err := resolveSnapshot(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	newDir, err := resolveSnapshot(fset.Arg(1))
+	if err != nil {
+		return err
+	}
+	before, err := snapshotPackages(oldDir)
+	if err != nil {
+		return err
+	}
+	after, err := snapshotPackages(newDir)
+	if err != nil {
+		return err
+	}
+
+	if *pkg != "" {
+		o, n := before[*pkg], after[*pkg]
+		if o == nil && n == nil {
+			return fmt.Errorf("src:%s is contained in neither %s nor %s", *pkg, oldDir, newDir)
+		}
+		return diffFiles(o, n)
+	}
+
+	changes := diffPackages(before, after)
+	if *format == "json" {
+		if changes == nil {
+			changes = []packageChange{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Change]++
+		switch c.Change {
+		case "added":
+			fmt.Printf("%-10s %s %s\n", c.Change, c.Package, c.NewVersion)
+		case "removed":
+			fmt.Printf("%-10s %s %s\n", c.Change, c.Package, c.OldVersion)
+		case "changed":
+			fmt.Printf("%-10s %s %s (different tarballs)\n", c.Change, c.Package, c.NewVersion)
+		default:
+			fmt.Printf("%-10s %s %s → %s\n", c.Change, c.Package, c.OldVersion, c.NewVersion)
+		}
+	}
+	log.Printf("%d added, %d removed, %d upgraded, %d downgraded, %d changed",
+		counts["added"], counts["removed"], counts["upgraded"], counts["downgraded"], counts["changed"])
+	return nil
+}
+
+// treeFiles returns the paths (relative to dir) of all non-directory files of
+// the package tree in dir, excluding the quilt state directory (.pc) and nested
+// package trees of other source packages.
+func treeFiles(dir string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == dir {
+				return nil
+			}
+			if info.Name() == ".pc" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+				return filepath.SkipDir // another source package
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = true
+		return nil
+	})
+	return files, err
+}
+
+// sameContents reports whether the files a and b have identical contents.
+// Unreadable files (e.g. dangling symlinks) are treated as different, leaving
+// it to diff(1) to report them.
+func sameContents(a, b string) bool {
+	ab, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	bb, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// diffFiles prints a unified diff between the package trees of o and n, either
+// of which might be nil (i.e. the package was added or removed). Nested package
+// trees are left out, as they are diffed as packages of their own.
+func diffFiles(o, n *snapshotPackage) error {
+	oldFiles, newFiles := make(map[string]bool), make(map[string]bool)
+	var oldDir, newDir string
+	var err error
+	if o != nil {
+		oldDir = o.Dir
+		if oldFiles, err = treeFiles(oldDir); err != nil {
+			return err
+		}
+	}
+	if n != nil {
+		newDir = n.Dir
+		if newFiles, err = treeFiles(newDir); err != nil {
+			return err
+		}
+	}
+	var rels []string
+	for rel := range oldFiles {
+		rels = append(rels, rel)
+	}
+	for rel := range newFiles {
+		if !oldFiles[rel] {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		// diff -N treats missing files as empty:
+		oldPath, newPath := filepath.Join(oldDir, rel), filepath.Join(newDir, rel)
+		if oldDir == "" {
+			oldPath = os.DevNull
+		}
+		if newDir == "" {
+			newPath = os.DevNull
+		}
+		if oldFiles[rel] && newFiles[rel] && sameContents(oldPath, newPath) {
+			continue
+		}
+		cmd := exec.Command("diff", "-uN", oldPath, newPath)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 1 {
+				continue // differences found
+			}
+			return fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	failurePolicy = flag.String("failure_policy",
+		"fail-fast",
+		"What to do when processing a source package fails (e.g. due to a corrupt tarball): fail-fast aborts the run without creating a snapshot, best-effort leaves out the package (see -quarantine) and aborts only if more than -max_failures source packages failed")
+
+	maxFailures = flag.Int("max_failures",
+		20,
+		"With -failure_policy=best-effort, the maximum number of source packages which may fail before the run is aborted. Negative values mean no limit.")
+
+	quarantine = flag.String("quarantine",
+		"",
+		"With -failure_policy=best-effort, the directory into which the package trees of failed source packages are moved (as <dir>/<timestamp>/<source package>) for inspection, instead of deleting them")
+)
+
+// Categories of skipped and failed source packages.
+const (
+	categoryIgnored    = "ignored"     // see -policy
+	categoryImportPath = "import-path" // missing Go-Import-Path
+	categoryCollision  = "collision"   // see -collision_policy
+	categorySource     = "source"      // unsupported source format or unexpected files
+	categoryDownload   = "download"
+	categoryUnpack     = "unpack"
+	categoryPatch      = "patch" // 1.0 diff or quilt series does not apply
+	categoryDebhelper  = "debhelper"
+	categoryOther      = "other" // e.g. I/O errors
+)
+
+// pkgError is an error processing one source package.
+type pkgError struct {
+	Category string
+	Err      error
+}
+
+func (e *pkgError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Category, e.Err)
+}
+
+// categorize returns err as a *pkgError, using category unless err already is
+// a *pkgError (or a *patchError, which is categorized as patch).
+func categorize(category string, err error) error {
+	switch err.(type) {
+	case *pkgError:
+		return err
+	case *patchError:
+		return &pkgError{Category: categoryPatch, Err: err}
+	}
+	return &pkgError{Category: category, Err: err}
+}
+
+// failures counts failed source packages to enforce -max_failures.
+type failures struct {
+	bestEffort bool
+	max        int
+	quarantine string // directory, or empty to delete failed package trees
+	timestamp  string // of the snapshot
+
+	mu sync.Mutex
+	n  int
+}
+
+func newFailures(policy string, max int, quarantine string) (*failures, error) {
+	f := &failures{max: max, quarantine: quarantine}
+	switch policy {
+	case "fail-fast":
+	case "best-effort":
+		f.bestEffort = true
+	default:
+		return nil, fmt.Errorf("unknown -failure_policy %q: expected fail-fast or best-effort", policy)
+	}
+	return f, nil
+}
+
+// handle deals with err, which occurred while processing src into the package
+// tree dir: with -failure_policy=best-effort, the package tree is quarantined
+// (or deleted) and a manifest of the failed package is returned, unless
+// -max_failures is exceeded. Otherwise, err is returned.
+func (f *failures) handle(src *sourceIndex, dir string, err error) (*packageManifest, error) {
+	pe := categorize(categoryOther, err).(*pkgError)
+	if !f.bestEffort {
+		return nil, fmt.Errorf("src:%s: %v", src.Package, pe)
+	}
+	f.mu.Lock()
+	f.n++
+	n := f.n
+	f.mu.Unlock()
+	log.Printf("src:%s: FAILED: %v", src.Package, pe)
+	if f.max > -1 && n > f.max {
+		return nil, fmt.Errorf("more than -max_failures=%d source packages failed, aborting (latest: src:%s: %v)", f.max, src.Package, pe)
+	}
+	if f.quarantine != "" {
+		qdir := filepath.Join(f.quarantine, f.timestamp)
+		dest := filepath.Join(qdir, src.Package)
+		if err := os.MkdirAll(qdir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(dir, dest); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("quarantining src:%s: %v", src.Package, err)
+		}
+	} else if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return newPackageManifest(src).fail(pe.Category, pe.Err.Error()), nil
+}
+
+// summarize logs the skipped and failed source packages by category, and
+// returns the failed ones (for the manifest).
+func summarize(packages []*packageManifest) map[string][]string {
+	byStatus := map[string]map[string][]string{
+		statusSkipped: make(map[string][]string),
+		statusFailed:  make(map[string][]string),
+	}
+	var ok int
+	for _, pm := range packages {
+		if pm.Status == statusOK {
+			ok++
+			continue
+		}
+		byStatus[pm.Status][pm.Category] = append(byStatus[pm.Status][pm.Category], pm.Package)
+	}
+	count := func(m map[string][]string) int {
+		var n int
+		for _, pkgs := range m {
+			n += len(pkgs)
+		}
+		return n
+	}
+	log.Printf("summary: %d ok, %d skipped, %d failed",
+		ok, count(byStatus[statusSkipped]), count(byStatus[statusFailed]))
+	for _, status := range []string{statusSkipped, statusFailed} {
+		m := byStatus[status]
+		categories := make([]string, 0, len(m))
+		for category, pkgs := range m {
+			sort.Strings(pkgs)
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		for _, category := range categories {
+			log.Printf("summary: %s (%s): %d: %s", status, category, len(m[category]), strings.Join(m[category], ", "))
+		}
+	}
+	if len(byStatus[statusFailed]) == 0 {
+		return nil
+	}
+	return byStatus[statusFailed]
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"pault.ag/go/archive"
+	"pault.ag/go/debian/control"
+)
+
+// Source package formats supported by process, see dpkg-source(1).
+const (
+	format1       = "1.0"
+	format3Quilt  = "3.0 (quilt)"
+	format3Native = "3.0 (native)"
+)
+
+// Kinds of source package files.
+const (
+	kindOrig      = "orig"      // upstream tarball
+	kindComponent = "component" // additional upstream tarball, see sourceFile.component
+	kindDebian    = "debian"    // debian/ directory tarball (3.0 (quilt))
+	kindDiff      = "diff"      // gzip-compressed diff (1.0)
+	kindNative    = "native"    // tarball of a native package
+)
+
+var (
+	origRe      = regexp.MustCompile(`\.orig\.tar\.[a-z0-9]+$`)
+	componentRe = regexp.MustCompile(`\.orig-([a-zA-Z0-9][-a-zA-Z0-9]*)\.tar\.[a-z0-9]+$`)
+	debianRe    = regexp.MustCompile(`\.debian\.tar\.[a-z0-9]+$`)
+	diffRe      = regexp.MustCompile(`\.diff\.gz$`)
+	nativeRe    = regexp.MustCompile(`\.tar\.[a-z0-9]+$`)
+)
+
+// sourceFile is a file of a source package, with its path relative to the
+// mirror.
+type sourceFile struct {
+	control.FileHash
+	kind      string
+	component string // directory to unpack a component tarball into
+}
+
+// sourceFiles returns the files of src in the order in which they need to be
+// unpacked, as per the source format of src. Signatures (.asc) are ignored. An
+// error is returned for unsupported formats and unexpected files.
+func sourceFiles(src *sourceIndex) (string, []sourceFile, error) {
+	format := src.Format
+	if format == "" {
+		format = format1 // as per dpkg-source(1)
+	}
+	if format != format1 && format != format3Quilt && format != format3Native {
+		return format, nil, fmt.Errorf("unsupported source format %q", format)
+	}
+	counts := make(map[string]int)
+	var files []sourceFile
+	for _, c := range src.Checksums() {
+		if strings.HasSuffix(c.Filename, ".asc") || strings.HasSuffix(c.Filename, ".dsc") {
+			continue
+		}
+		f := sourceFile{FileHash: c}
+		f.Filename = path.Join(src.Directory, c.Filename)
+		switch {
+		case origRe.MatchString(c.Filename):
+			f.kind = kindOrig
+		case componentRe.MatchString(c.Filename):
+			f.kind = kindComponent
+			f.component = componentRe.FindStringSubmatch(c.Filename)[1]
+		case debianRe.MatchString(c.Filename):
+			f.kind = kindDebian
+		case diffRe.MatchString(c.Filename):
+			f.kind = kindDiff
+		case nativeRe.MatchString(c.Filename):
+			f.kind = kindNative
+		default:
+			return format, nil, fmt.Errorf("unexpected file %s", c.Filename)
+		}
+		counts[f.kind]++
+		files = append(files, f)
+	}
+
+	var want map[string]int // number of files per kind, -1 for any number
+	switch format {
+	case format3Quilt:
+		want = map[string]int{kindOrig: 1, kindComponent: -1, kindDebian: 1}
+	case format3Native:
+		want = map[string]int{kindNative: 1}
+	case format1:
+		if counts[kindNative] > 0 {
+			want = map[string]int{kindNative: 1}
+		} else {
+			want = map[string]int{kindOrig: 1, kindDiff: 1}
+		}
+	}
+	for _, kind := range []string{kindOrig, kindComponent, kindDebian, kindDiff, kindNative} {
+		n, ok := want[kind]
+		if !ok && counts[kind] > 0 {
+			return format, nil, fmt.Errorf("unexpected %s file in %s package", kind, format)
+		}
+		if ok && n > -1 && counts[kind] != n {
+			return format, nil, fmt.Errorf("expected %d %s file(s) in %s package, found %d", n, kind, format, counts[kind])
+		}
+	}
+
+	order := map[string]int{kindOrig: 0, kindNative: 0, kindComponent: 1, kindDebian: 2, kindDiff: 2}
+	sort.SliceStable(files, func(i, j int) bool {
+		if oi, oj := order[files[i].kind], order[files[j].kind]; oi != oj {
+			return oi < oj
+		}
+		return files[i].component < files[j].component
+	})
+	return format, files, nil
+}
+
+// unpackSourceFile downloads f and unpacks it into the package tree in dir,
+// like dpkg-source -x does. Errors applying a 1.0 diff are of type
+// *patchError, download and unpack errors of type *pkgError.
+func unpackSourceFile(g *archive.Downloader, dir string, f sourceFile) error {
+	tmp, err := g.TempFile(f.FileHash)
+	if err != nil {
+		return &pkgError{Category: categoryDownload, Err: fmt.Errorf("download(%s): %v", f.Filename, err)}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	dest := dir
+	switch f.kind {
+	case kindComponent:
+		// The component tarball replaces the directory of the same name,
+		// should the orig tarball contain one.
+		dest = filepath.Join(dir, f.component)
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	case kindDebian:
+		// Likewise, the debian tarball replaces the debian directory.
+		dest = filepath.Join(dir, "debian")
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	case kindDiff:
+		return applyDiffGz(dir, tmp.Name(), path.Base(f.Filename))
+	}
+	if err := unpack(dest, tmp.Name()); err != nil {
+		return &pkgError{Category: categoryUnpack, Err: fmt.Errorf("unpacking %s tarball: %v", f.kind, err)}
+	}
+	return nil
+}
@@ -1,5 +1,6 @@
 // Program pgt-gopath constructs a Go workspace src directory from the Debian
-// unstable archive. See https://golang.org/doc/code.html#Workspaces
+// unstable archive (or any combination of suites and components, see -suites
+// and -components). See https://golang.org/doc/code.html#Workspaces
 //
 // This is useful, for example, for quick continuous integration: gone is the
 // computationally intensive step of identifying reverse dependencies of Debian
@@ -18,52 +19,92 @@
 // tarballs from the Debian archive. This typically takes less than 10 seconds
 // on a modern computer.
 //
-// The resulting src directory is suffixed with the UNIX timestamp of the
-// release metadata’s last modified timestamp. In case the last modified
-// timestamp matches the current on-disk timestamp, pgt-gopath immediately exits
-// successfully. Hence, it can be run in a minutely cronjob.
+// Source packages are unpacked like dpkg-source -x would (formats 1.0, 3.0
+// (quilt) and 3.0 (native) are supported), including their quilt patch series.
 //
-// This last modified timestamp is printed to stdout (whereas log messages are
-// printed to stderr). This allows for post-processing (e.g. chmod) and
-// atomically updating the Go workspace via:
+// With -layout=goproxy, pgt-gopath instead writes each source package as a Go
+// module into a GOPROXY file system tree (goproxy-<timestamp>), so that module
+// mode builds can resolve against the Debian archive using
+// GOPROXY=file://$PWD/goproxy-<timestamp> GOFLAGS=-mod=mod. Module paths are
+// taken from go.mod (if present) or Go-Import-Path, module versions are derived
+// from the Debian upstream version.
+//
+// With -incremental, package trees whose debian/.hashes are unchanged since the
+// latest src-<timestamp> directory are hardlinked (or reflinked, see -reuse)
+// instead of being downloaded and unpacked again.
+//
+// Source packages can be ignored, and their Go-Import-Path can be rewritten, by
+// a policy file (see -policy and policy.json), which documents why for each
+// entry. pgt-gopath warns about entries which are no longer needed.
+//
+// By default, a source package which cannot be processed (e.g. due to a
+// corrupt tarball) aborts the run. With -failure_policy=best-effort, it is left
+// out of the snapshot instead (see -max_failures and -quarantine). Either way,
+// the run ends with a summary of skipped and failed source packages by
+// category, which is also recorded in the manifest.
+//
+// Source packages declaring multiple import paths in Go-Import-Path are
+// unpacked at the first one, the others (aliases) are symlinks to it.
+//
+// Source packages claiming the same import path (or shipping files within the
+// import path of another source package) are resolved as per -collision_policy
+// and -collision_prefer, and can be reported with -collision_report.
 //
-//    #!/bin/bash
-//    # Not safe for concurrent execution: wrap in flock(1) or a systemd service.
-//    set -e
+// “pgt-gopath serve” serves the latest src-<timestamp> directory via the
+// GOPROXY protocol, switching to new snapshots as they appear.
 //
-//    # Update pgt-gopath to pick up fixes:
-//    go get -u github.com/Debian/pkg-go-team/cmd/pgt-gopath
+// “pgt-gopath diff <old> <new>” lists the source packages which were added,
+// removed or upgraded between two snapshots.
 //
-//    mkdir -p /srv/gopath
-//    cd /srv/gopath
+// “pgt-gopath rdeps <import path>” lists the source packages of the workspace
+// which (transitively) import the specified import path, based on the import
+// statements of their Go files.
 //
-//    # Create a new src-<timestamp> directory:
-//    latest=$(pgt-gopath)
+// “pgt-gopath check” builds and tests all source packages of the workspace in
+// GOPATH mode and reports failures (optionally as JUnit XML and HTML).
+// “pgt-gopath compare -new_goroot=<dir>” does the same with two Go toolchains
+// and reports source packages which pass with one, but fail with the other.
 //
-//    # Atomically update the src symlink:
-//    ln -snf src-${latest} new_src
-//    mv -T new_src src
+// “pgt-gopath batch <.dsc file, pool directory or Sources file>…” layers local
+// source packages (e.g. pending uploads) onto the latest snapshot, creating a
+// new snapshot (batch-<timestamp>) to build and test them together with the
+// archive. “pgt-gopath overlay <checkout directory>…” does the same for local
+// gbp-style packaging checkouts (overlay-<timestamp>), e.g. to find reverse
+// dependencies broken by in-progress packaging before uploading it.
 //
-//    # Clean up all old src-<timestamp> directories:
-//    rm -rf -- $(ls -d src-* | grep -v "^src-$latest\$")
+// The resulting src directory is suffixed with the UNIX timestamp of the
+// release metadata’s last modified timestamp. In case the last modified
+// timestamp matches the current on-disk timestamp, pgt-gopath immediately exits
+// successfully. Hence, it can be run in a minutely cronjob. Concurrent runs
+// within the same directory are prevented by a lock file (see -lock).
+//
+// This last modified timestamp is printed to stdout (whereas log messages are
+// printed to stderr). With -publish, pgt-gopath atomically updates the src
+// symlink to point to the new src-<timestamp> directory, runs the
+// -post_publish_hook (e.g. for post-processing) and deletes old
+// src-<timestamp> directories as per -keep and -keep_younger_than:
+//
+//	mkdir -p /srv/gopath
+//	cd /srv/gopath
+//	pgt-gopath -publish -keep=2
 package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 	"pault.ag/go/archive"
-	"pault.ag/go/debian/control"
 )
 
 var (
@@ -71,133 +112,215 @@ var (
 		"http://localhost:3142/deb.debian.org/debian",
 		"HTTP URL of the Debian mirror to use. Install apt-cacher-ng(8) instead of specifying this flag to massively cut down on bandwidth (useful even with fast links).")
 
+	suites = flag.String("suites",
+		"unstable",
+		"Comma-separated list of suites (e.g. unstable,experimental) to layer on top of each other. As with apt, the highest version of each source package wins. Use a separate working directory per list of suites, as the resulting src-<timestamp> directories are not distinguishable otherwise.")
+
+	components = flag.String("components",
+		"main",
+		"Comma-separated list of archive components (e.g. main,contrib) to include")
+
+	layout = flag.String("layout",
+		"gopath",
+		"Output layout: gopath creates a GOPATH/src directory src-<timestamp>, goproxy creates a GOPROXY file system tree goproxy-<timestamp>, to be used with GOPROXY=file://$PWD/goproxy-<timestamp> GOFLAGS=-mod=mod")
+
 	dsc = flag.String("dsc",
 		"",
-		"Path to a single .dsc file to unpack, instead of operating on Debian unstable. Note that the destination is first deleted, then unpacked from scratch (i.e. not atomic), as this flag is only supposed to be used when working within a filesystem overlay.")
+		"Path to a single .dsc file to unpack, instead of operating on the Debian archive. Note that the destination is first deleted, then unpacked from scratch (i.e. not atomic), as this flag is only supposed to be used when working within a filesystem overlay.")
 )
 
-var ignored = map[string]bool{
-	"kxd":         true, // not go-gettable, but also no dependencies other than the stdlib. ignore for now.
-	"golang-1.6":  true, // compiler
-	"golang-1.7":  true, // compiler
-	"golang-1.8":  true, // compiler
-	"golang-1.9":  true, // compiler
-	"golang-1.10": true, // compiler
-}
+// process unpacks src into the package tree importPath within tempdir (or
+// reuses its tree from prev). Errors are of type *pkgError.
+func process(g *archive.Downloader, tempdir, importPath string, src *sourceIndex, prev *previousSnapshot) (*packageManifest, error) {
+	pm := newPackageManifest(src)
+	pm.Dir = importPath
+	pm.ImportPaths = []string{importPath}
 
-// rewrite maps from Debian source package to Go-Import-Path. Each entry is
-// annotated with a URL of the upstream-submitted patch and should be removed
-// once that patch is merged.
-var rewrite = map[string]string{
-	"gitlab-workhorse":                  "gitlab.com/gitlab-org/gitlab-workhorse", // https://bugs.debian.org/890056
-	"pluginhook":                        "github.com/progrium/pluginhook",         // https://bugs.debian.org/890057
-	"golang-github-gosexy-gettext":      "github.com/gosexy/gettext",              // https://bugs.debian.org/890058
-	"mongo-tools":                       "github.com/mongodb/mongo-tools",         // https://bugs.debian.org/890059
-	"golang-github-mvo5-goconfigparser": "github.com/mvo5/goconfigparser",         // https://github.com/vorlonofportland/goconfigparser/pull/1
-}
-
-func process(g *archive.Downloader, tempdir, importPath string, src *sourceIndex) error {
-	var origTar, debTar control.FileHash
-	for _, c := range src.Checksums() {
-		if strings.HasSuffix(c.Filename, ".asc") {
-			continue // skip signature files
-		}
-		if strings.Contains(c.Filename, ".orig.tar.") {
-			origTar = c
-		} else if strings.Contains(c.Filename, ".debian.tar.") {
-			debTar = c
-		}
-	}
-	if origTar.Filename == "" {
-		log.Printf("ERROR: src:%s is missing .orig.tar. file", src.Package)
-		return nil
-	}
-	if debTar.Filename == "" {
-		log.Printf("ERROR: src:%s is missing .debian.tar. file", src.Package)
-		return nil
-	}
-	origTar.Filename = path.Join(src.Directory, origTar.Filename)
-	origTarTmp, err := g.TempFile(origTar)
+	format, files, err := sourceFiles(src)
+	pm.Format = format
 	if err != nil {
-		return fmt.Errorf("src:%s: download(origTar=%s): %v", src.Package, origTar.Filename, err)
+		return nil, categorize(categorySource, err)
 	}
-	if err := origTarTmp.Close(); err != nil {
-		return err
+	// All hashes which define the package are persisted into the
+	// debian/.hashes file. This can be used by downstream software (and
+	// -incremental) to detect package changes for caching.
+	var lines []string
+	for _, f := range files {
+		pm.Tarballs = append(pm.Tarballs, tarball{Name: f.Filename, Hash: f.Algorithm + ":" + f.Hash})
+		lines = append(lines, f.Filename+"="+f.Hash)
 	}
-	defer os.Remove(origTarTmp.Name())
+	hashes := []byte(strings.Join(lines, "\n") + "\n")
 
-	debTar.Filename = path.Join(src.Directory, debTar.Filename)
-	debTarTmp, err := g.TempFile(debTar)
-	if err != nil {
-		return fmt.Errorf("src:%s: download(debTar=%s): %v", src.Package, debTar.Filename, err)
-	}
-	if err := debTarTmp.Close(); err != nil {
-		return err
+	destRepo := filepath.Join(tempdir, importPath)
+	pm.outcome = added
+	if prevHashes := prev.hashes(importPath); prevHashes != nil {
+		if !bytes.Equal(prevHashes, hashes) {
+			pm.outcome = updated
+		} else {
+			if err := copyTree(filepath.Join(prev.dir, importPath), destRepo, prev.reuse); err != nil {
+				return nil, categorize(categoryOther, fmt.Errorf("reusing previous tree: %v", err))
+			}
+			// The patches were applied when the tree was first created.
+			if format != format3Native {
+				patches, err := seriesPatches(destRepo)
+				if err != nil {
+					return nil, categorize(categoryPatch, err)
+				}
+				pm.Patches = patches
+			}
+			links, err := createLinks(tempdir, destRepo)
+			if err != nil {
+				return nil, categorize(categoryDebhelper, fmt.Errorf("creating links: %v", err))
+			}
+			pm.Links = links
+			// debian/.suite changes when a package migrates between suites,
+			// and must not be modified in place (see -reuse).
+			suitePath := filepath.Join(destRepo, "debian", ".suite")
+			if err := os.Remove(suitePath); err != nil && !os.IsNotExist(err) {
+				return nil, categorize(categoryOther, err)
+			}
+			if err := writeSuite(suitePath, src.Suite); err != nil {
+				return nil, categorize(categoryOther, err)
+			}
+			pm.outcome = reused
+			return pm, nil
+		}
 	}
-	defer os.Remove(debTarTmp.Name())
 
-	destRepo := filepath.Join(tempdir, importPath)
-	if err := unpack(destRepo, origTarTmp.Name()); err != nil {
-		return fmt.Errorf("unpacking orig tarball: %v", err)
+	for _, f := range files {
+		if err := unpackSourceFile(g, destRepo, f); err != nil {
+			return nil, categorize(categoryOther, err)
+		}
 	}
-	if err := unpack(filepath.Join(destRepo, "debian"), debTarTmp.Name()); err != nil {
-		return fmt.Errorf("unpacking debian tarball: %v", err)
+	if err := finishTree(tempdir, destRepo, src, pm, false, hashes); err != nil {
+		return nil, err
 	}
-	if err := applyPatches(destRepo); err != nil {
-		return fmt.Errorf("applying patches: %v", err)
+	return pm, nil
+}
+
+// finishTree completes the package tree of src at destRepo within tempdir
+// once its files are in place: it applies the quilt series (unless applied is
+// true, e.g. by gbp pq), creates the links of debian/links, removes the files
+// of debian/clean and writes debian/.hashes and debian/.suite. pm is updated
+// accordingly. Errors are of type *pkgError.
+func finishTree(tempdir, destRepo string, src *sourceIndex, pm *packageManifest, applied bool, hashes []byte) error {
+	if pm.Format != format3Native {
+		var patches []string
+		var err error
+		if applied {
+			patches, err = seriesPatches(destRepo)
+		} else {
+			// dpkg-source only applies the quilt series of 3.0 (quilt)
+			// packages, but 1.0 packages using quilt apply it during the
+			// build.
+			patches, err = applyPatches(destRepo)
+		}
+		if err != nil {
+			if pe, ok := err.(*patchError); ok && *patchReport != "" {
+				reportPatchFailure(src, pe)
+			}
+			return categorize(categoryOther, err)
+		}
+		pm.Patches = patches
 	}
-	if err := createLinks(tempdir, destRepo); err != nil {
-		return fmt.Errorf("creating links: %v", err)
+	links, err := createLinks(tempdir, destRepo)
+	if err != nil {
+		return categorize(categoryDebhelper, fmt.Errorf("creating links: %v", err))
 	}
+	pm.Links = links
 	if err := cleanFiles(destRepo); err != nil {
-		return fmt.Errorf("cleaning files: %v", err)
+		return categorize(categoryDebhelper, fmt.Errorf("cleaning files: %v", err))
 	}
 
-	// enforce resulting files are world-readable for building with unprivileged
-	// users (e.g. golang-github-svent-go-nbreader comes with a debian tarball
-	// without word-readable bits). Permissions were copied from “apt source”.
-	chmod := exec.Command("chmod", "-R", "--", "u+r+w+X,g+r-w+X,o+r-w+X", destRepo)
-	chmod.Stderr = os.Stderr
-	if err := chmod.Run(); err != nil {
-		return fmt.Errorf("%v: %v", chmod.Args, err)
-	}
-
-	// Persist all hashes which define the package into the
-	// debian/.hashes file. This can be used by downstream software to
-	// detect package changes for caching.
-	hashes := []byte(strings.Join([]string{
-		origTar.Filename + "=" + origTar.Hash,
-		debTar.Filename + "=" + debTar.Hash,
-	}, "\n") + "\n")
 	if err := ioutil.WriteFile(filepath.Join(destRepo, "debian", ".hashes"), hashes, 0644); err != nil {
-		return err
+		return categorize(categoryOther, err)
+	}
+	if err := writeSuite(filepath.Join(destRepo, "debian", ".suite"), src.Suite); err != nil {
+		return categorize(categoryOther, err)
 	}
-
 	return nil
 }
 
+// writeSuite records which suite the package came from in the debian/.suite
+// file, as the resulting tree might combine multiple suites (see -suites).
+func writeSuite(filename, suite string) error {
+	if suite == "" {
+		return nil
+	}
+	return ioutil.WriteFile(filename, []byte(suite+"\n"), 0644)
+}
+
 func logic() error {
 	const parallel = 20
 	g := &archive.Downloader{
 		Parallel:            parallel,
 		MaxTransientRetries: 3,
 		Mirror:              strings.TrimSuffix(*debianMirror, "/"),
-		// TODO: insecure flag to skip GPG verification on systems missing DebianArchiveKeyring
 	}
-	if *dsc != "" {
-		g.LocalMirror = filepath.Dir(*dsc)
-		var src sourceIndex
-		b, err := ioutil.ReadFile(*dsc)
+	if *keyringPath != "" && *insecureSkipVerify {
+		return fmt.Errorf("-keyring and -insecure_skip_verify are mutually exclusive")
+	}
+	if *keyringPath != "" {
+		keyring, err := loadKeyring(*keyringPath)
 		if err != nil {
 			return err
 		}
-		if err := control.Unmarshal(&src, bytes.NewReader(b)); err != nil {
+		g.Keyring = keyring
+	}
+	pol, err := loadPolicy(*policyPath)
+	if err != nil {
+		return err
+	}
+	if *dsc != "" {
+		g.LocalMirror = "/" // Directory is absolute
+		src, err := readDsc(*dsc)
+		if err != nil {
 			return err
 		}
 		if err := os.RemoveAll(filepath.Join("src/" + src.importPath())); err != nil {
 			return err
 		}
-		return process(g, "src/", src.importPath(), &src)
+		_, err = process(g, "src/", src.importPath(), &src, nil)
+		return err
+	}
+
+	var prefix string
+	switch *layout {
+	case "gopath":
+		prefix = "src-"
+	case "goproxy":
+		prefix = "goproxy-"
+	default:
+		return fmt.Errorf("unknown -layout %q: expected gopath or goproxy", *layout)
+	}
+	cols, err := newCollisions(*collisionPolicy, *collisionPrefer)
+	if err != nil {
+		return err
+	}
+	fails, err := newFailures(*failurePolicy, *maxFailures, *quarantine)
+	if err != nil {
+		return err
+	}
+
+	l, err := lock(*lockPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	link := strings.TrimSuffix(prefix, "-")
+
+	var prev *previousSnapshot
+	if *incremental && *layout == "gopath" {
+		fn, err := reuseFuncFor(*reuse)
+		if err != nil {
+			return err
+		}
+		if snap, err := latestSnapshot("."); err != nil {
+			log.Printf("-incremental: %v, processing all packages", err)
+		} else {
+			prev = &previousSnapshot{dir: snap.Path, reuse: fn}
+			log.Printf("-incremental: reusing unchanged packages of %s", snap.Name)
+		}
 	}
 
 	start := time.Now()
@@ -207,32 +330,69 @@ func logic() error {
 	}
 	defer os.RemoveAll(tempdir)
 
-	release, rd, err := g.Release("unstable")
-	if err != nil {
-		return err
+	if *insecureSkipVerify {
+		log.Printf("WARNING: -insecure_skip_verify specified: the authenticity of %s will NOT be verified!", g.Mirror)
+	}
+	var releases []*suiteRelease
+	var lastModified time.Time
+	var verification []suiteVerification
+	for _, suite := range strings.Split(*suites, ",") {
+		r, err := fetchRelease(g, suite)
+		if err != nil {
+			return fmt.Errorf("%s: %v", suite, err)
+		}
+		if r.lastModified.After(lastModified) {
+			lastModified = r.lastModified
+		}
+		verification = append(verification, suiteVerification{Suite: suite, Verified: r.verified})
+		releases = append(releases, r)
 	}
-	timestamp := fmt.Sprintf("%d", rd.LastModified.Unix())
-	if _, err := os.Stat("src-" + timestamp); err == nil {
+	timestamp := fmt.Sprintf("%d", lastModified.Unix())
+	fails.timestamp = timestamp
+	if _, err := os.Stat(prefix + timestamp); err == nil {
+		if *publish {
+			// A previous run might have been interrupted before publishing.
+			if err := publishSnapshot(link, prefix, timestamp); err != nil {
+				return err
+			}
+		}
 		fmt.Println(timestamp)
 		return nil
 	}
-	const sourcesPath = "main/source/Sources.gz"
-	fhs := release.Indices()[sourcesPath]
-	if len(fhs) == 0 {
-		return fmt.Errorf("%s not found", sourcesPath)
-	}
-	srcs, err := downloadSources(rd, fhs[0])
-	if err != nil {
-		return err
+	var srcs []sourceIndex
+	for _, r := range releases {
+		for _, component := range strings.Split(*components, ",") {
+			sourcesPath := component + "/source/Sources.gz"
+			fhs := r.release.Indices()[sourcesPath]
+			if len(fhs) == 0 {
+				return fmt.Errorf("%s: %s not found", r.suite, sourcesPath)
+			}
+			layer, err := downloadSources(r.tempFile, fhs[0])
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", r.suite, sourcesPath, err)
+			}
+			for idx := range layer {
+				layer[idx].Suite = r.suite
+			}
+			srcs = mergeSources(srcs, layer)
+		}
 	}
 	log.Printf("loaded %d source packages in %v", len(srcs), time.Since(start))
+	pol.warnStale(srcs)
 
 	// Process the repos, 20 at a time.
-	var eg errgroup.Group
+	eg, ctx := errgroup.WithContext(context.Background())
 	semaphore := make(chan struct{}, parallel)
 
+	var (
+		packagesMu sync.Mutex
+		packages   []*packageManifest
+		processed  []sourceIndex
+		candidates []sourceIndex
+	)
 	for _, src := range srcs {
 		if ignored[src.Package] {
+			packages = append(packages, newPackageManifest(&src).skip(categoryIgnored, "ignored"))
 			continue
 		}
 		if src.ExtraSourceOnly {
@@ -241,34 +401,155 @@ func logic() error {
 		if src.importPath() == "" {
 			// TODO: document what this means
 			log.Printf("package src:%s is missing xs-go-import-path", src.Package)
+			packages = append(packages, newPackageManifest(&src).skip(categoryImportPath, "missing Go-Import-Path"))
 			continue
 		}
-		if src.importPath() == "github.com/spf13/cobra" {
-			log.Printf("pkg = %v", src.Package)
-		}
-		if src.Package == "golang-github-dnephin-cobra" {
-			continue // TODO: file bug: same import path: golang-github-dnephin-cobra vs. golang-github-spf13-cobra
-		}
-
-		if src.Package == "docker-containerd" {
-			continue // TODO: file bug: duplicate package: src:docker-containerd vs. src:containerd
-		}
+		candidates = append(candidates, src)
+	}
+	candidates, aliases, collided, err := cols.exact(candidates)
+	if err != nil {
+		return err
+	}
+	packages = append(packages, collided...)
 
+	// Nested package trees are processed once their enclosing package trees are
+	// complete, so that collisions between them are detected deterministically.
+	byPath := make(map[string]string, len(candidates)) // import path → source package
+	done := make(map[string]chan struct{}, len(candidates))
+	for _, src := range candidates {
+		byPath[src.importPath()] = src.Package
+		done[src.importPath()] = make(chan struct{})
+	}
+	for _, src := range candidates {
 		src := src // copy
 		eg.Go(func() error {
+			defer close(done[src.importPath()])
+			for _, p := range enclosing(src.importPath(), byPath) {
+				<-done[p]
+			}
+
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
+			if ctx.Err() != nil {
+				return nil // the run is aborted, see eg.Wait
+			}
+
+			pm, err := cols.checkNested(&src, tempdir, byPath)
+			if err != nil {
+				return err
+			}
+			if pm != nil {
+				packagesMu.Lock()
+				defer packagesMu.Unlock()
+				packages = append(packages, pm)
+				return nil
+			}
 
-			return process(g, tempdir, src.importPath(), &src)
+			pm, err = process(g, tempdir, src.importPath(), &src, prev)
+			omitted := false
+			if err != nil {
+				// With -failure_policy=best-effort, the package tree is
+				// left out of the snapshot.
+				if pm, err = fails.handle(&src, filepath.Join(tempdir, src.importPath()), err); err != nil {
+					return err
+				}
+				omitted = true
+			}
+			packagesMu.Lock()
+			defer packagesMu.Unlock()
+			packages = append(packages, pm)
+			if !omitted {
+				processed = append(processed, src)
+			}
+			return nil
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
+		summarize(packages)
+		if *patchReport != "" {
+			if err := writePatchReport(); err != nil {
+				log.Printf("writing -patch_report: %v", err)
+			}
+		}
 		return err
 	}
 
-	if err := os.Rename(tempdir, "src-"+timestamp); err != nil {
-		return err
+	// Aliases are created once all package trees are complete, in a
+	// deterministic order, as they must not collide with any package tree.
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Package < packages[j].Package })
+	for _, pm := range packages {
+		if pm.Status != statusOK || pm.Dir == "" {
+			continue // no package tree to point the aliases to
+		}
+		if len(aliases[pm.Package]) > 0 {
+			created, err := cols.createAliases(tempdir, pm.Package, pm.Dir, aliases[pm.Package], byPath)
+			if err != nil {
+				return fmt.Errorf("src:%s: creating aliases: %v", pm.Package, err)
+			}
+			pm.ImportPaths = append(pm.ImportPaths, created...)
+		}
+		pm.LostAliases = cols.lostAliases(pm.Package)
+	}
+
+	if *patchReport != "" {
+		if err := writePatchReport(); err != nil {
+			return err
+		}
+	}
+
+	if *collisionReport != "" {
+		if err := cols.write(*collisionReport); err != nil {
+			return err
+		}
+	}
+
+	if prev != nil {
+		importPaths := make(map[string]bool, len(processed))
+		for _, src := range processed {
+			importPaths[src.importPath()] = true
+		}
+		removed, err := removedTrees(prev.dir, importPaths)
+		if err != nil {
+			return err
+		}
+		outcomes := make(map[outcome]int)
+		for _, pm := range packages {
+			outcomes[pm.outcome]++
+		}
+		log.Printf("-incremental: %d reused, %d updated, %d added, %d removed in %v",
+			outcomes[reused], outcomes[updated], outcomes[added], removed, time.Since(start))
+	}
+
+	failed := summarize(packages)
+	m := &manifest{
+		Timestamp:    lastModified.UTC(),
+		Mirror:       g.Mirror,
+		Suites:       strings.Split(*suites, ","),
+		Components:   strings.Split(*components, ","),
+		Verification: verification,
+		Keyring:      *keyringPath,
+		Packages:     packages,
+		Failures:     failed,
+	}
+
+	if *layout == "goproxy" {
+		if err := writeProxy(tempdir, prefix+timestamp, lastModified, processed, m); err != nil {
+			return err
+		}
+	} else {
+		if err := m.write(tempdir); err != nil {
+			return err
+		}
+		if err := os.Rename(tempdir, prefix+timestamp); err != nil {
+			return err
+		}
+	}
+
+	if *publish {
+		if err := publishSnapshot(link, prefix, timestamp); err != nil {
+			return err
+		}
 	}
 
 	fmt.Println(timestamp)
@@ -278,7 +559,28 @@ func logic() error {
 
 func main() {
 	flag.Parse()
-	if err := logic(); err != nil {
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		err = logic()
+	case "serve":
+		err = serve(flag.Args()[1:])
+	case "diff":
+		err = diff(flag.Args()[1:])
+	case "rdeps":
+		err = rdeps(flag.Args()[1:])
+	case "check":
+		err = check(flag.Args()[1:])
+	case "compare":
+		err = compare(flag.Args()[1:])
+	case "batch":
+		err = batch(flag.Args()[1:])
+	case "overlay":
+		err = overlayCheckouts(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown subcommand %q", flag.Arg(0))
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
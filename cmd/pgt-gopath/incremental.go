@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	incremental = flag.Bool("incremental",
+		false,
+		"Reuse the package trees of the latest src-<timestamp> snapshot whose debian/.hashes match the Sources index, instead of downloading and unpacking every package again. Only applies to -layout=gopath.")
+
+	reuse = flag.String("reuse",
+		"hardlink",
+		"How -incremental reuses unchanged package trees: hardlink (files are shared between snapshots, so never modify them in place) or reflink (copy-on-write clones, requires e.g. btrfs or XFS)")
+)
+
+// outcome describes what process did with a source package.
+type outcome int
+
+const (
+	skipped outcome = iota // e.g. missing tarballs
+	added                  // not present in the previous snapshot
+	updated                // present in the previous snapshot with different hashes
+	reused                 // unchanged since the previous snapshot
+)
+
+// reuseFunc makes the file newname refer to the contents of oldname.
+type reuseFunc func(oldname, newname string) error
+
+func reuseFuncFor(method string) (reuseFunc, error) {
+	switch method {
+	case "hardlink":
+		return os.Link, nil
+	case "reflink":
+		return reflink, nil
+	default:
+		return nil, fmt.Errorf("unknown -reuse %q: expected hardlink or reflink", method)
+	}
+}
+
+// previousSnapshot is the snapshot which -incremental reuses package trees of.
+type previousSnapshot struct {
+	dir   string
+	reuse reuseFunc
+}
+
+// hashes returns the contents of the debian/.hashes file of the package tree
+// importPath, or nil if the previous snapshot does not contain it.
+func (p *previousSnapshot) hashes(importPath string) []byte {
+	if p == nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(p.dir, importPath, "debian", ".hashes"))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// copyTree recreates the package tree src at dest, using fn for regular
+// files. Nested package trees of other source packages are skipped, as they
+// are reused (or updated) on their own.
+func copyTree(src, dest string, fn reuseFunc) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			if rel != "." {
+				if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+					return filepath.SkipDir // another source package
+				}
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			oldname, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(oldname, target); err != nil && !os.IsExist(err) {
+				return err // links created by other packages might already exist
+			}
+			return nil
+		case info.Mode().IsRegular():
+			return fn(path, target)
+		default:
+			return nil // package trees contain no devices, pipes, etc.
+		}
+	})
+}
+
+// removedTrees returns how many package trees of the previous snapshot prev
+// are not part of the new snapshot, i.e. not in importPaths.
+func removedTrees(prev string, importPaths map[string]bool) (int, error) {
+	trees, err := packageTrees(prev)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, tree := range trees {
+		if !importPaths[tree.ImportPath] {
+			n++
+		}
+	}
+	return n, nil
+}
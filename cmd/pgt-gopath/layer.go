@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resolveBase returns the snapshot to layer packages onto: arg (a directory
+// or timestamp, see resolveSnapshot), or if empty, the published src snapshot
+// or the latest src-<timestamp> snapshot. Symlinks are evaluated.
+func resolveBase(arg string) (string, error) {
+	dir := arg
+	if arg != "" {
+		var err error
+		if dir, err = resolveSnapshot(arg); err != nil {
+			return "", err
+		}
+	} else if _, err := os.Stat("src"); err == nil {
+		dir = "src"
+	} else {
+		snap, err := latestSnapshot(".")
+		if err != nil {
+			return "", err
+		}
+		dir = snap.Path
+	}
+	// e.g. src, which filepath.Walk would not descend into:
+	return filepath.EvalSymlinks(dir)
+}
+
+// baseTrees returns the source package of each package tree of the snapshot
+// in dir, keyed by import path.
+func baseTrees(dir string) (map[string]string, error) {
+	trees, err := packageTrees(dir)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make(map[string]string, len(trees))
+	for _, tree := range trees {
+		pkg, _, err := changelogEntry(tree.Dir)
+		if err != nil {
+			log.Printf("%s: %v", tree.ImportPath, err)
+			pkg = tree.ImportPath
+		}
+		pkgs[tree.ImportPath] = pkg
+	}
+	return pkgs, nil
+}
+
+// copySnapshot recreates the snapshot src at dest, hardlinking regular files.
+// The package trees whose import paths are in omit are left out, but package
+// trees nested within them are not. Manifests are not copied.
+func copySnapshot(src, dest string, omit map[string]bool) error {
+	var walk func(rel string, skip bool) error
+	walk = func(rel string, skip bool) error {
+		dir := filepath.Join(src, rel)
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !skip {
+			// Omitted package trees must not leave empty directories behind.
+			if err := os.MkdirAll(filepath.Join(dest, rel), fi.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			path := filepath.Join(rel, fi.Name())
+			switch {
+			case rel == "." && strings.HasPrefix(fi.Name(), "manifest."):
+				continue
+			case fi.IsDir():
+				childSkip := skip
+				if _, err := os.Stat(filepath.Join(src, path, "debian", ".hashes")); err == nil {
+					childSkip = omit[filepath.ToSlash(path)]
+				}
+				if err := walk(path, childSkip); err != nil {
+					return err
+				}
+			case skip:
+				continue
+			case fi.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(filepath.Join(src, path))
+				if err != nil {
+					return err
+				}
+				if err := os.Symlink(target, filepath.Join(dest, path)); err != nil {
+					return err
+				}
+			case fi.Mode().IsRegular():
+				if err := os.Link(filepath.Join(src, path), filepath.Join(dest, path)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(".", false)
+}
+
+// readManifest reads the manifest.json file of the snapshot in dir, if any.
+func readManifest(dir string) (*manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &manifest{}, nil // created by an older version of pgt-gopath
+		}
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, "manifest.json"), err)
+	}
+	return &m, nil
+}
+
+// layerSnapshot creates the snapshot dest (atomically) from the snapshot in
+// baseDir and srcs, which replace the package trees of the same source
+// packages and those at the same import paths. Source packages ignored by
+// -policy are left out, including those of the base snapshot. fn creates the
+// package tree of a source package in tempdir, like process does. name
+// describes srcs in log messages.
+func layerSnapshot(baseDir, dest, name string, srcs []sourceIndex, fn func(tempdir string, src *sourceIndex) (*packageManifest, error)) error {
+	cols, err := newCollisions(*collisionPolicy, *collisionPrefer)
+	if err != nil {
+		return err
+	}
+	fails, err := newFailures(*failurePolicy, *maxFailures, *quarantine)
+	if err != nil {
+		return err
+	}
+	fails.timestamp = filepath.Base(dest)
+
+	start := time.Now()
+	var packages []*packageManifest
+	var candidates []sourceIndex
+	ignoredSrcs := make(map[string]bool)
+	for _, src := range srcs {
+		if ignored[src.Package] {
+			ignoredSrcs[src.Package] = true
+			packages = append(packages, newPackageManifest(&src).skip(categoryIgnored, "ignored"))
+			continue
+		}
+		if src.importPath() == "" {
+			log.Printf("package src:%s is missing xs-go-import-path", src.Package)
+			packages = append(packages, newPackageManifest(&src).skip(categoryImportPath, "missing Go-Import-Path"))
+			continue
+		}
+		candidates = append(candidates, src)
+	}
+	candidates, aliases, collided, err := cols.exact(candidates)
+	if err != nil {
+		return err
+	}
+	packages = append(packages, collided...)
+	log.Printf("loaded %d %s", len(candidates), name)
+
+	// The local source packages replace the package trees of the same source
+	// package, and those at the same import path. Package trees of ignored
+	// source packages are dropped.
+	trees, err := baseTrees(baseDir)
+	if err != nil {
+		return err
+	}
+	replaced := make(map[string]bool)
+	byPkg := make(map[string]bool, len(candidates))
+	for _, src := range candidates {
+		byPkg[src.Package] = true
+		if _, ok := trees[src.importPath()]; ok {
+			replaced[src.importPath()] = true
+		}
+	}
+	byPath := make(map[string]string, len(trees)+len(candidates)) // import path → source package
+	for importPath, pkg := range trees {
+		if ignored[pkg] {
+			log.Printf("dropping src:%s (%s): ignored by -policy", pkg, importPath)
+			replaced[importPath] = true
+			continue
+		}
+		if byPkg[pkg] {
+			replaced[importPath] = true
+			continue
+		}
+		if !replaced[importPath] {
+			byPath[importPath] = pkg
+		}
+	}
+	for importPath := range replaced {
+		if ignored[trees[importPath]] {
+			continue
+		}
+		log.Printf("replacing src:%s (%s)", trees[importPath], importPath)
+	}
+	for _, src := range candidates {
+		byPath[src.importPath()] = src.Package
+	}
+
+	tempdir, err := ioutil.TempDir(filepath.Dir(dest), filepath.Base(dest)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempdir)
+	if err := copySnapshot(baseDir, tempdir, replaced); err != nil {
+		return fmt.Errorf("copying %s: %v", baseDir, err)
+	}
+
+	// Enclosing package trees are processed first, see logic. Note that
+	// package trees of the base snapshot which are nested within a local
+	// source package are kept as they are.
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].importPath() < candidates[j].importPath() })
+	for _, src := range candidates {
+		src := src // copy
+		pm, err := cols.checkNested(&src, tempdir, byPath)
+		if err != nil {
+			return err
+		}
+		if pm != nil {
+			packages = append(packages, pm)
+			continue
+		}
+		pm, err = fn(tempdir, &src)
+		if err != nil {
+			if pm, err = fails.handle(&src, filepath.Join(tempdir, src.importPath()), err); err != nil {
+				summarize(packages)
+				if *patchReport != "" {
+					if err := writePatchReport(); err != nil {
+						log.Printf("writing -patch_report: %v", err)
+					}
+				}
+				return err
+			}
+		} else {
+			if len(aliases[src.Package]) > 0 {
+				created, err := cols.createAliases(tempdir, src.Package, src.importPath(), aliases[src.Package], byPath)
+				if err != nil {
+					return fmt.Errorf("src:%s: creating aliases: %v", src.Package, err)
+				}
+				pm.ImportPaths = append(pm.ImportPaths, created...)
+			}
+			pm.LostAliases = cols.lostAliases(src.Package)
+		}
+		packages = append(packages, pm)
+	}
+	if *patchReport != "" {
+		if err := writePatchReport(); err != nil {
+			return err
+		}
+	}
+	if *collisionReport != "" {
+		if err := cols.write(*collisionReport); err != nil {
+			return err
+		}
+	}
+
+	m, err := readManifest(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, pm := range m.Packages {
+		if ignored[pm.Package] {
+			if !ignoredSrcs[pm.Package] {
+				packages = append(packages, (&packageManifest{
+					Package: pm.Package,
+					Version: pm.Version,
+					Suite:   pm.Suite,
+				}).skip(categoryIgnored, "ignored"))
+			}
+			continue
+		}
+		if byPkg[pm.Package] || (pm.Dir != "" && replaced[pm.Dir]) {
+			continue
+		}
+		packages = append(packages, pm)
+	}
+	m.Base = baseDir
+	m.Packages = packages
+	m.Failures = summarize(packages)
+	if err := m.write(tempdir); err != nil {
+		return err
+	}
+	if err := os.Rename(tempdir, dest); err != nil {
+		return err
+	}
+	log.Printf("created %s from %s and %d %s in %v", dest, baseDir, len(candidates), name, time.Since(start))
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var manifestControl = flag.Bool("manifest_control",
+	false,
+	"In addition to manifest.json, write the manifest in Debian control format (one paragraph per source package) to manifest.control in the snapshot directory")
+
+// manifest describes how a snapshot was constructed and what it contains. It
+// is written to the manifest.json file in the snapshot directory.
+type manifest struct {
+	Timestamp  time.Time `json:"timestamp"` // last modified timestamp of the release metadata
+	Mirror     string    `json:"mirror"`
+	Suites     []string  `json:"suites"`
+	Components []string  `json:"components"`
+
+	// Verification records, per suite, whether the signature of its Release
+	// file was verified, i.e. not with -insecure_skip_verify.
+	Verification []suiteVerification `json:"verification"`
+	Keyring      string              `json:"keyring,omitempty"` // -keyring, if specified
+
+	// Base is the snapshot which local source packages were layered onto (see
+	// the batch subcommand), if any.
+	Base string `json:"base,omitempty"`
+
+	Packages []*packageManifest `json:"packages"`
+
+	// Failures lists the failed source packages by category (see
+	// -failure_policy).
+	Failures map[string][]string `json:"failures,omitempty"`
+}
+
+// suiteVerification describes whether the release metadata of a suite was
+// verified.
+type suiteVerification struct {
+	Suite    string `json:"suite"`
+	Verified bool   `json:"verified"`
+}
+
+// Status values of packageManifest.
+const (
+	statusOK      = "ok"
+	statusSkipped = "skipped" // not part of the snapshot, e.g. missing Go-Import-Path
+	statusFailed  = "failed"  // not part of the snapshot, see -failure_policy
+)
+
+// packageManifest describes one source package of a snapshot.
+type packageManifest struct {
+	Package     string      `json:"package"`
+	Version     string      `json:"version"`
+	Suite       string      `json:"suite,omitempty"`
+	Format      string      `json:"format,omitempty"` // source format, e.g. 3.0 (quilt)
+	Dir         string      `json:"dir,omitempty"`    // relative to the snapshot directory
+	ImportPaths []string    `json:"import_paths,omitempty"`
+	LostAliases []lostAlias `json:"lost_aliases,omitempty"` // declared aliases which were not created
+	Tarballs    []tarball   `json:"tarballs,omitempty"`     // including 1.0 diffs
+	Patches     []string    `json:"patches,omitempty"`      // as listed in debian/patches/series
+	Links       []symlink   `json:"links,omitempty"`        // see debian/links
+	Status      string      `json:"status"`
+	Category    string      `json:"category,omitempty"` // why the package was skipped or failed, in short
+	Reason      string      `json:"reason,omitempty"`   // why the package was skipped or failed
+
+	outcome outcome // for -incremental
+}
+
+// lostAlias is an alias (additional Go-Import-Path entry) which was not
+// created, as another source package won the import path collision.
+type lostAlias struct {
+	ImportPath string `json:"import_path"`
+	Winner     string `json:"winner,omitempty"` // empty if all colliding packages were skipped
+}
+
+type tarball struct {
+	Name string `json:"name"` // relative to the mirror
+	Hash string `json:"hash"` // <algorithm>:<hex digest>
+}
+
+// symlink is a symbolic link created as per debian/links.
+type symlink struct {
+	Name   string `json:"name"`   // relative to the snapshot directory
+	Target string `json:"target"` // relative to the snapshot directory
+}
+
+func newPackageManifest(src *sourceIndex) *packageManifest {
+	return &packageManifest{
+		Package: src.Package,
+		Version: src.Version.String(),
+		Suite:   src.Suite,
+		Status:  statusOK,
+	}
+}
+
+func (pm *packageManifest) skip(category, reason string) *packageManifest {
+	pm.Status, pm.Category, pm.Reason = statusSkipped, category, reason
+	return pm
+}
+
+func (pm *packageManifest) fail(category, reason string) *packageManifest {
+	pm.Status, pm.Category, pm.Reason = statusFailed, category, reason
+	return pm
+}
+
+// write writes m to the manifest.json file (and, with -manifest_control, to the
+// manifest.control file) in dir.
+func (m *manifest) write(dir string) error {
+	sort.Slice(m.Packages, func(i, j int) bool { return m.Packages[i].Package < m.Packages[j].Package })
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	if !*manifestControl {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "manifest.control"), m.control(), 0644)
+}
+
+// control returns m in Debian control format, i.e. RFC822-style paragraphs
+// with multi-line fields (like the Checksums-* fields of Sources indices).
+func (m *manifest) control() []byte {
+	var buf bytes.Buffer
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	multiline := func(name string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "%s:\n", name)
+		for _, line := range lines {
+			fmt.Fprintf(&buf, " %s\n", line)
+		}
+	}
+	for idx, pm := range m.Packages {
+		if idx > 0 {
+			buf.WriteString("\n")
+		}
+		field("Package", pm.Package)
+		field("Version", pm.Version)
+		field("Suite", pm.Suite)
+		field("Format", pm.Format)
+		field("Directory", pm.Dir)
+		field("Import-Paths", strings.Join(pm.ImportPaths, ", "))
+		var lost []string
+		for _, l := range pm.LostAliases {
+			winner := l.Winner
+			if winner == "" {
+				winner = "-"
+			}
+			lost = append(lost, l.ImportPath+" "+winner)
+		}
+		multiline("Lost-Aliases", lost)
+		var tarballs []string
+		for _, t := range pm.Tarballs {
+			tarballs = append(tarballs, t.Hash+" "+t.Name)
+		}
+		multiline("Tarballs", tarballs)
+		multiline("Patches", pm.Patches)
+		var links []string
+		for _, l := range pm.Links {
+			links = append(links, l.Target+" "+l.Name)
+		}
+		multiline("Links", links)
+		field("Status", pm.Status)
+		field("Category", pm.Category)
+		field("Reason", pm.Reason)
+	}
+	return buf.Bytes()
+}
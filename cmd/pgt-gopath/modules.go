@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+	"golang.org/x/sync/errgroup"
+)
+
+// modulePath returns the module path of the package tree in dir, and the
+// contents of its go.mod file. Trees without a go.mod file are treated as
+// modules named after their import path.
+func modulePath(dir, importPath string) (string, []byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return importPath, []byte(fmt.Sprintf("module %s\n", importPath)), nil
+		}
+		return "", nil, err
+	}
+	mp := modfile.ModulePath(b)
+	if mp == "" {
+		return "", nil, fmt.Errorf("%s: no module directive found", filepath.Join(dir, "go.mod"))
+	}
+	return mp, b, nil
+}
+
+var (
+	// snapshotRe matches Debian upstream versions of VCS snapshots, e.g.
+	// 0.0~git20180101.abcdef1 or 1.2.3+git20180101.1.abcdef1.
+	snapshotRe = regexp.MustCompile(`^(.*?)([~+])git(\d{8})(?:\.\d+)?\.([0-9a-f]{7,40})$`)
+
+	// releaseRe matches the release part of Debian upstream versions, e.g.
+	// 1.2.3, 1.2 or 1.2.3~rc1.
+	releaseRe = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:~([0-9A-Za-z.-]+))?$`)
+)
+
+// stripRepackSuffix removes Debian-specific suffixes which indicate repacked
+// upstream tarballs, e.g. +dfsg1 or +ds.
+func stripRepackSuffix(upstream string) string {
+	for _, suffix := range []string{"+dfsg", "+ds", "+repack"} {
+		if idx := strings.Index(upstream, suffix); idx > -1 {
+			return upstream[:idx]
+		}
+	}
+	return upstream
+}
+
+// moduleVersion derives the module version of modulePath from the upstream
+// part of a Debian version: releases become semantic versions, VCS snapshots
+// become pseudo-versions.
+func moduleVersion(upstream, modulePath string, hasGoMod bool) (string, error) {
+	upstream = stripRepackSuffix(upstream)
+
+	var v string
+	if matches := snapshotRe.FindStringSubmatch(upstream); matches != nil {
+		base, sep, date, rev := matches[1], matches[2], matches[3], matches[4]
+		timestamp := date + "000000"
+		if base == "0.0" || base == "0" || base == "" {
+			v = "v0.0.0-" + timestamp + "-" + rev
+		} else {
+			rm := releaseRe.FindStringSubmatch(base)
+			if rm == nil {
+				return "", fmt.Errorf("cannot derive module version from %q", upstream)
+			}
+			major, minor, patch := rm[1], orZero(rm[2]), orZero(rm[3])
+			if sep == "+" {
+				// A snapshot after the release: increment the patch version as
+				// the go tool would.
+				var p int
+				fmt.Sscanf(patch, "%d", &p)
+				patch = fmt.Sprintf("%d", p+1)
+			}
+			v = fmt.Sprintf("v%s.%s.%s-0.%s-%s", major, minor, patch, timestamp, rev)
+		}
+	} else {
+		rm := releaseRe.FindStringSubmatch(upstream)
+		if rm == nil {
+			return "", fmt.Errorf("cannot derive module version from %q", upstream)
+		}
+		v = fmt.Sprintf("v%s.%s.%s", rm[1], orZero(rm[2]), orZero(rm[3]))
+		if rm[4] != "" {
+			v += "-" + rm[4]
+		}
+	}
+	if !semver.IsValid(v) {
+		return "", fmt.Errorf("derived module version %q from %q is invalid", v, upstream)
+	}
+
+	_, pathMajor, _ := module.SplitPathVersion(modulePath)
+	if err := module.CheckPathMajor(v, pathMajor); err != nil {
+		if pathMajor != "" || hasGoMod {
+			return "", err
+		}
+		// e.g. v2.0.0 of a module without go.mod and without /v2 suffix:
+		v += "+incompatible"
+	}
+	return v, nil
+}
+
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+// moduleFile implements modzip.File for files of a package tree.
+type moduleFile struct {
+	path     string // slash-separated, relative to the module root
+	filePath string
+	info     os.FileInfo
+}
+
+func (f moduleFile) Path() string                 { return f.path }
+func (f moduleFile) Lstat() (os.FileInfo, error)  { return f.info, nil }
+func (f moduleFile) Open() (io.ReadCloser, error) { return os.Open(f.filePath) }
+
+// moduleFiles returns the files of the package tree in dir which belong into
+// its module zip, i.e. excluding Debian packaging and nested package trees of
+// other source packages.
+func moduleFiles(dir string) ([]modzip.File, error) {
+	var files []modzip.File
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch rel {
+			case "debian", ".pc":
+				return filepath.SkipDir
+			}
+			switch info.Name() {
+			case ".git", ".hg", ".svn", ".bzr":
+				return filepath.SkipDir
+			}
+			if rel != "." {
+				if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+					return filepath.SkipDir // another source package
+				}
+			}
+			return nil
+		}
+		files = append(files, moduleFile{
+			path:     filepath.ToSlash(rel),
+			filePath: path,
+			info:     info,
+		})
+		return nil
+	})
+	return files, err
+}
+
+// goModule describes the module which a package tree constitutes.
+type goModule struct {
+	Path    string
+	Version string
+	GoMod   []byte // contents of the go.mod file, possibly synthesized
+	Dir     string // package tree
+}
+
+// moduleForTree returns the module of the package tree in dir, whose Debian
+// upstream version is upstream.
+func moduleForTree(dir, importPath, upstream string) (*goModule, error) {
+	mp, goMod, err := modulePath(dir, importPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(filepath.Join(dir, "go.mod"))
+	hasGoMod := err == nil
+	v, err := moduleVersion(upstream, mp, hasGoMod)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", mp, err)
+	}
+	return &goModule{
+		Path:    mp,
+		Version: v,
+		GoMod:   goMod,
+		Dir:     dir,
+	}, nil
+}
+
+// writeZip writes the module zip file of m to w.
+func (m *goModule) writeZip(w io.Writer) error {
+	files, err := moduleFiles(m.Dir)
+	if err != nil {
+		return err
+	}
+	return modzip.Create(w, module.Version{Path: m.Path, Version: m.Version}, files)
+}
+
+// info returns the contents of the module’s .info file.
+func (m *goModule) info(t time.Time) ([]byte, error) {
+	return json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{m.Version, t.UTC()})
+}
+
+// writeModule writes m into the GOPROXY file system layout rooted at proxyDir
+// (see “go help goproxy”), i.e. it creates
+// <module>/@v/{list,<version>.info,<version>.mod,<version>.zip}.
+func writeModule(proxyDir string, m *goModule, t time.Time) error {
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return err
+	}
+	vdir := filepath.Join(proxyDir, filepath.FromSlash(escPath), "@v")
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		return err
+	}
+
+	zf, err := os.Create(filepath.Join(vdir, escVersion+".zip"))
+	if err != nil {
+		return err
+	}
+	defer zf.Close()
+	if err := m.writeZip(zf); err != nil {
+		return err
+	}
+	if err := zf.Close(); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(vdir, escVersion+".mod"), m.GoMod, 0644); err != nil {
+		return err
+	}
+	info, err := m.info(t)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(vdir, escVersion+".info"), info, 0644); err != nil {
+		return err
+	}
+	// Each snapshot contains precisely one version per module:
+	return ioutil.WriteFile(filepath.Join(vdir, "list"), []byte(m.Version+"\n"), 0644)
+}
+
+// writeProxy writes all srcs (which were processed into srcdir) as modules
+// into a GOPROXY file system tree, which is then renamed to dest.
+func writeProxy(srcdir, dest string, t time.Time, srcs []sourceIndex, m *manifest) error {
+	start := time.Now()
+	proxyDir, err := ioutil.TempDir(".", "goproxy-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(proxyDir)
+
+	// Determine the modules up front: two package trees may constitute the
+	// same module (e.g. a fork which kept the module path in its go.mod), in
+	// which case the one with the lexically smallest import path is written,
+	// like serve does.
+	sorted := make([]sourceIndex, len(srcs))
+	copy(sorted, srcs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].importPath() < sorted[j].importPath() })
+	var modules []*goModule
+	byPath := make(map[string]sourceIndex)
+	for _, src := range sorted {
+		dir := filepath.Join(srcdir, src.importPath())
+		if _, err := os.Stat(filepath.Join(dir, "debian", ".hashes")); err != nil {
+			continue // skipped by process, which already logged why
+		}
+		mod, err := moduleForTree(dir, src.importPath(), src.Version.Version)
+		if err != nil {
+			log.Printf("src:%s: not writing module: %v", src.Package, err)
+			continue
+		}
+		if other, ok := byPath[mod.Path]; ok {
+			log.Printf("src:%s: module %s already provided by src:%s, skipping", src.Package, mod.Path, other.Package)
+			continue
+		}
+		byPath[mod.Path] = src
+		modules = append(modules, mod)
+	}
+
+	var eg errgroup.Group
+	semaphore := make(chan struct{}, 20)
+	for _, mod := range modules {
+		mod := mod // copy
+		src := byPath[mod.Path]
+		eg.Go(func() error {
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if err := writeModule(proxyDir, mod, t); err != nil {
+				log.Printf("src:%s: not writing module: %v", src.Package, err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	log.Printf("wrote %d modules in %v", len(modules), time.Since(start))
+
+	if err := m.write(proxyDir); err != nil {
+		return err
+	}
+
+	return os.Rename(proxyDir, dest)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"pault.ag/go/debian/version"
+)
+
+func TestModuleVersion(t *testing.T) {
+	for _, tt := range []struct {
+		upstream   string
+		modulePath string
+		hasGoMod   bool
+		want       string // empty if an error is expected
+	}{
+		// Releases:
+		{"1.2.3", "example.com/foo", true, "v1.2.3"},
+		{"1.2", "example.com/foo", true, "v1.2.0"},
+		{"1", "example.com/foo", false, "v1.0.0"},
+		{"1.2~rc1", "example.com/foo", true, "v1.2.0-rc1"},
+		{"1.2.3~beta.2", "example.com/foo", true, "v1.2.3-beta.2"},
+
+		// Repacked upstream tarballs:
+		{"1.2.3+dfsg", "example.com/foo", true, "v1.2.3"},
+		{"1.2.3+dfsg1", "example.com/foo", true, "v1.2.3"},
+		{"1.2.3+ds", "example.com/foo", true, "v1.2.3"},
+		{"1.2.3+ds1", "example.com/foo", true, "v1.2.3"},
+		{"0.0~git20180101.abcdef1+ds", "example.com/foo", true, "v0.0.0-20180101000000-abcdef1"},
+
+		// VCS snapshots:
+		{"0.0~git20180101.abcdef1", "example.com/foo", false, "v0.0.0-20180101000000-abcdef1"},
+		{"0.0~git20180101.1.abcdef1", "example.com/foo", false, "v0.0.0-20180101000000-abcdef1"},
+		{"0~git20180101.abcdef1", "example.com/foo", false, "v0.0.0-20180101000000-abcdef1"},
+		{"1.2.3+git20180101.abcdef1", "example.com/foo", true, "v1.2.4-0.20180101000000-abcdef1"},
+		{"1.2+git20180101.1.abcdef1", "example.com/foo", true, "v1.2.1-0.20180101000000-abcdef1"},
+		{"1.2.3~git20180101.abcdef1", "example.com/foo", true, "v1.2.3-0.20180101000000-abcdef1"},
+
+		// Major versions:
+		{"2.1.0", "example.com/foo/v2", true, "v2.1.0"},
+		{"2.1.0", "gopkg.in/yaml.v2", false, "v2.1.0"},
+		{"2.1.0", "example.com/foo", false, "v2.1.0+incompatible"},
+		{"2.1.0+git20180101.abcdef1", "example.com/foo", false, "v2.1.1-0.20180101000000-abcdef1+incompatible"},
+		{"2.1.0", "example.com/foo", true, ""},    // go.mod without /v2 suffix
+		{"1.2.3", "example.com/foo/v2", true, ""}, // /v2 suffix for v1
+		{"3.0.0", "example.com/foo/v2", true, ""},
+
+		// Not derivable:
+		{"r57", "example.com/foo", true, ""},
+		{"1.2.3.4", "example.com/foo", true, ""},
+		{"1.2.3+git20180101", "example.com/foo", true, ""},
+	} {
+		got, err := moduleVersion(tt.upstream, tt.modulePath, tt.hasGoMod)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("moduleVersion(%q, %q, %v) = %q, want error", tt.upstream, tt.modulePath, tt.hasGoMod, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("moduleVersion(%q, %q, %v): %v", tt.upstream, tt.modulePath, tt.hasGoMod, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("moduleVersion(%q, %q, %v) = %q, want %q", tt.upstream, tt.modulePath, tt.hasGoMod, got, tt.want)
+		}
+	}
+}
+
+func TestWriteProxyDuplicateModules(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// A fork which kept the module path of the original in its go.mod file:
+	var srcs []sourceIndex
+	for _, tree := range []struct{ pkg, importPath, body string }{
+		{"golang-github-fork-foo", "github.com/fork/foo", "package foo // fork\n"},
+		{"golang-example-foo", "example.com/foo", "package foo\n"},
+	} {
+		for fn, contents := range map[string]string{
+			"go.mod":         "module example.com/foo\n",
+			"foo.go":         tree.body,
+			"debian/.hashes": "",
+		} {
+			path := filepath.Join(dir, "src", filepath.FromSlash(tree.importPath), filepath.FromSlash(fn))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		srcs = append(srcs, sourceIndex{
+			Package:      tree.pkg,
+			GoImportPath: tree.importPath,
+			Version:      version.Version{Version: "1.0.0", Revision: "1"},
+		})
+	}
+
+	dest := filepath.Join(dir, "goproxy-1")
+	if err := writeProxy(filepath.Join(dir, "src"), dest, time.Now(), srcs, &manifest{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dest, path)
+		got = append(got, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com/foo/@v/list",
+		"example.com/foo/@v/v1.0.0.info",
+		"example.com/foo/@v/v1.0.0.mod",
+		"example.com/foo/@v/v1.0.0.zip",
+		"manifest.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected files: got %q, want %q", got, want)
+	}
+	// example.com/foo sorts before github.com/fork/foo:
+	m, err := moduleForTree(filepath.Join(dir, "src", "example.com", "foo"), "example.com/foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zip, err := ioutil.ReadFile(filepath.Join(dest, "example.com", "foo", "@v", "v1.0.0.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.writeZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(zip) != buf.String() {
+		t.Errorf("module zip not created from %s", m.Dir)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pault.ag/go/debian/control"
+)
+
+// checkoutControl is the source paragraph of debian/control.
+type checkoutControl struct {
+	Source       string
+	GoImportPath string `control:"XS-Go-Import-Path"`
+}
+
+// readCheckout reads the gbp-style packaging checkout in dir (an upstream tree
+// with the debian/ directory). Directory is set to the absolute path of dir.
+func readCheckout(dir string) (sourceIndex, error) {
+	var src sourceIndex
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return src, err
+	}
+	f, err := os.Open(filepath.Join(abs, "debian", "control"))
+	if err != nil {
+		return src, err
+	}
+	defer f.Close()
+	var ctrl checkoutControl
+	if err := control.Unmarshal(&ctrl, f); err != nil {
+		return src, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	pkg, v, err := changelogEntry(abs)
+	if err != nil {
+		return src, err
+	}
+	if ctrl.Source != "" && ctrl.Source != pkg {
+		return src, fmt.Errorf("%s: source package %q does not match debian/changelog (%q)", f.Name(), ctrl.Source, pkg)
+	}
+	format, err := ioutil.ReadFile(filepath.Join(abs, "debian", "source", "format"))
+	if err != nil && !os.IsNotExist(err) {
+		return src, err
+	}
+	src.Package = pkg
+	src.Version = v
+	src.GoImportPath = ctrl.GoImportPath
+	src.Format = strings.TrimSpace(string(format))
+	src.Directory = abs
+	return src, nil
+}
+
+// checkoutRevision returns the git commit of the checkout in dir, suffixed with
+// -dirty if it has uncommitted changes, or “unknown” outside of git.
+func checkoutRevision(dir string) string {
+	rev, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+	revision := strings.TrimSpace(string(rev))
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil || len(bytes.TrimSpace(status)) > 0 {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// copyCheckout copies the checkout src to dest, leaving out version control
+// metadata and the quilt state directory (.pc). Permissions are normalized as
+// for tarballs (see normalizedMode). Existing files and symlinks in
+// dest (e.g. within nested package trees kept from the base snapshot) are
+// replaced, like merge does.
+func copyCheckout(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			if name := info.Name(); rel != "." && (name == ".git" || name == ".pc") {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, normalizedPerm(true, info.Mode()))
+		case info.Mode()&os.ModeSymlink != 0:
+			oldname, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			return os.Symlink(oldname, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, normalizedPerm(false, info.Mode()))
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Remove first: the file might be hardlinked to the base snapshot (see
+	// copySnapshot).
+	if err := removeNonDir(dest); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// processCheckout creates the package tree importPath within tempdir from the
+// checkout of src, like process does for source packages of the archive.
+func processCheckout(tempdir, importPath string, src *sourceIndex) (*packageManifest, error) {
+	pm := newPackageManifest(src)
+	pm.Dir = importPath
+	pm.ImportPaths = []string{importPath}
+	pm.Format = src.Format
+	if pm.Format == "" {
+		pm.Format = format1
+	}
+	if pm.Format != format1 && pm.Format != format3Quilt && pm.Format != format3Native {
+		return nil, categorize(categorySource, fmt.Errorf("unsupported source format %q", pm.Format))
+	}
+	revision := checkoutRevision(src.Directory)
+	pm.Tarballs = []tarball{{Name: src.Directory, Hash: "git:" + revision}}
+
+	destRepo := filepath.Join(tempdir, importPath)
+	if err := copyCheckout(src.Directory, destRepo); err != nil {
+		return nil, categorize(categoryOther, fmt.Errorf("copying checkout: %v", err))
+	}
+	// The patches might have been applied in the checkout (e.g. gbp pq).
+	_, statErr := os.Stat(filepath.Join(src.Directory, ".pc", "applied-patches"))
+	applied := statErr == nil
+	hashes := []byte(src.Directory + "=" + revision + "\n")
+	if err := finishTree(tempdir, destRepo, src, pm, applied, hashes); err != nil {
+		return nil, err
+	}
+	pm.outcome = added
+	return pm, nil
+}
+
+// overlayCheckouts implements the overlay subcommand, which layers local
+// packaging checkouts (e.g. of Salsa repositories) onto an existing snapshot,
+// creating a new snapshot.
+func overlayCheckouts(args []string) error {
+	fset := flag.NewFlagSet("overlay", flag.ExitOnError)
+	var (
+		base = fset.String("base",
+			"",
+			"Snapshot (directory or timestamp) to layer the checkouts onto. Defaults to the published src snapshot, or the latest src-<timestamp> snapshot.")
+
+		output = fset.String("output",
+			"",
+			"Directory to create the new snapshot in (atomically). Defaults to overlay-<current UNIX timestamp>.")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath overlay [flags] <checkout directory>…\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	baseDir, err := resolveBase(*base)
+	if err != nil {
+		return err
+	}
+	dest := *output
+	if dest == "" {
+		dest = fmt.Sprintf("overlay-%d", time.Now().Unix())
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if _, err := loadPolicy(*policyPath); err != nil {
+		return err
+	}
+	var srcs []sourceIndex
+	for _, arg := range fset.Args() {
+		src, err := readCheckout(arg)
+		if err != nil {
+			return err
+		}
+		srcs = mergeSources(srcs, []sourceIndex{src})
+	}
+	fn := func(tempdir string, src *sourceIndex) (*packageManifest, error) {
+		return processCheckout(tempdir, src.importPath(), src)
+	}
+	if err := layerSnapshot(baseDir, dest, "local checkouts", srcs, fn); err != nil {
+		return err
+	}
+	fmt.Println(dest)
+	return nil
+}
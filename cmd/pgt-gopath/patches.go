@@ -1,47 +1,609 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-func applyPatches(dir string) error {
-	patchDir, err := filepath.Abs(filepath.Join(dir, "debian", "patches"))
+var patchReport = flag.String("patch_report",
+	"",
+	"Path of a file to write a report of all source packages whose patches do not apply to (also written when the run is aborted). Such packages fail as per -failure_policy, e.g. with best-effort, they are left out of the snapshot and counted towards -max_failures.")
+
+// maxFuzz is the maximum number of context lines which are ignored at the
+// beginning and end of a hunk when it does not apply otherwise, like the
+// default of patch(1).
+const maxFuzz = 2
+
+// seriesEntry is a patch listed in a quilt series file.
+type seriesEntry struct {
+	Patch   string // relative to the patches directory
+	Strip   int    // -pN, defaults to 1
+	Reverse bool   // -R
+}
+
+// parseSeries parses a quilt series file, see quilt(1).
+func parseSeries(b []byte) ([]seriesEntry, error) {
+	var entries []seriesEntry
+	for idx, line := range strings.Split(string(b), "\n") {
+		if pos := strings.Index(line, "#"); pos > -1 {
+			if pos == 0 || line[pos-1] == ' ' || line[pos-1] == '\t' {
+				line = line[:pos] // skip comments
+			}
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue // skip empty lines
+		}
+		e := seriesEntry{Patch: fields[0], Strip: 1}
+		for _, opt := range fields[1:] {
+			switch {
+			case opt == "-R":
+				e.Reverse = true
+			case strings.HasPrefix(opt, "-p"):
+				n, err := strconv.Atoi(strings.TrimPrefix(opt, "-p"))
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("series:%d: invalid option %q", idx+1, opt)
+				}
+				e.Strip = n
+			default:
+				return nil, fmt.Errorf("series:%d: unsupported option %q", idx+1, opt)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// hunkLine is a line of a hunk: op is ' ' (context), '-' (removed) or '+'
+// (added). text includes the trailing newline, unless the line is marked with
+// “\ No newline at end of file”.
+type hunkLine struct {
+	op   byte
+	text string
+}
+
+type hunk struct {
+	oldStart, oldLines int
+	newStart, newLines int
+	lines              []hunkLine
+}
+
+func (h *hunk) side(op byte) []string {
+	var lines []string
+	for _, l := range h.lines {
+		if l.op == ' ' || l.op == op {
+			lines = append(lines, l.text)
+		}
+	}
+	return lines
+}
+
+func (h *hunk) reverse() {
+	h.oldStart, h.newStart = h.newStart, h.oldStart
+	h.oldLines, h.newLines = h.newLines, h.oldLines
+	for idx, l := range h.lines {
+		switch l.op {
+		case '-':
+			h.lines[idx].op = '+'
+		case '+':
+			h.lines[idx].op = '-'
+		}
+	}
+}
+
+// fileDiff is the part of a patch which modifies one file.
+type fileDiff struct {
+	oldName, newName string // as specified in the patch, or /dev/null
+	hunks            []*hunk
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// headerName extracts the file name from a “--- ” or “+++ ” line, which might
+// be followed by a timestamp.
+func headerName(line string) string {
+	name := line[len("--- "):]
+	if idx := strings.IndexByte(name, '\t'); idx > -1 {
+		name = name[:idx]
+	}
+	return strings.TrimSpace(name)
+}
+
+// parsePatch parses the unified diffs contained in b. Any text before, between
+// and after diffs (e.g. DEP-3 headers) is ignored.
+func parsePatch(b []byte) ([]*fileDiff, error) {
+	var (
+		diffs []*fileDiff
+		fd    *fileDiff
+		// git extended headers of the current “diff --git” section:
+		renameFrom, renameTo string
+	)
+	flushRename := func() {
+		if renameFrom != "" && renameTo != "" && (fd == nil || fd.oldName != "a/"+renameFrom) {
+			// A pure rename without content changes has no ---/+++ lines.
+			diffs = append(diffs, &fileDiff{oldName: "a/" + renameFrom, newName: "b/" + renameTo})
+		}
+		renameFrom, renameTo = "", ""
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			flushRename()
+			fd = nil
+		case strings.HasPrefix(line, "rename from "):
+			renameFrom = strings.TrimPrefix(line, "rename from ")
+		case strings.HasPrefix(line, "rename to "):
+			renameTo = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "GIT binary patch"):
+			return nil, fmt.Errorf("line %d: binary patches are not supported", i+1)
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			fd = &fileDiff{
+				oldName: headerName(line),
+				newName: headerName(strings.TrimSuffix(lines[i+1], "\n")),
+			}
+			diffs = append(diffs, fd)
+			i++
+		case strings.HasPrefix(line, "@@ "):
+			if fd == nil {
+				return nil, fmt.Errorf("line %d: hunk without ---/+++ header", i+1)
+			}
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: malformed hunk header %q", i+1, line)
+			}
+			h := &hunk{
+				oldStart: atoi(m[1]),
+				oldLines: atoiDefault(m[2], 1),
+				newStart: atoi(m[3]),
+				newLines: atoiDefault(m[4], 1),
+			}
+			var oldSeen, newSeen int
+			for oldSeen < h.oldLines || newSeen < h.newLines {
+				i++
+				if i >= len(lines) || lines[i] == "" {
+					return nil, fmt.Errorf("line %d: hunk %q ends prematurely", i+1, line)
+				}
+				l := lines[i]
+				op := byte(' ')
+				text := "\n" // patches with trailing whitespace removed
+				if l != "\n" {
+					op, text = l[0], l[1:]
+				}
+				switch op {
+				case ' ':
+					oldSeen++
+					newSeen++
+				case '-':
+					oldSeen++
+				case '+':
+					newSeen++
+				default:
+					return nil, fmt.Errorf("line %d: unexpected line %q in hunk %q", i+1, strings.TrimSuffix(l, "\n"), line)
+				}
+				h.lines = append(h.lines, hunkLine{op: op, text: text})
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], `\`) {
+					// “\ No newline at end of file”
+					last := &h.lines[len(h.lines)-1]
+					last.text = strings.TrimSuffix(last.text, "\n")
+					i++
+				}
+			}
+			fd.hunks = append(fd.hunks, h)
+		}
+	}
+	flushRename()
+	return diffs, nil
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s) // guaranteed to be digits by hunkHeaderRe
+	return n
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	return atoi(s)
+}
+
+// stripPath removes the first n components of name, like patch -pN.
+func stripPath(name string, n int) (string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) <= n {
+		return "", fmt.Errorf("cannot strip %d components from %q", n, name)
+	}
+	stripped := filepath.Clean(filepath.FromSlash(strings.Join(parts[n:], "/")))
+	if filepath.IsAbs(stripped) || stripped == ".." || strings.HasPrefix(stripped, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes the package tree", name)
+	}
+	return stripped, nil
+}
+
+// fileLines splits b into lines, each including its trailing newline.
+func fileLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func matchAt(lines, want []string, pos int) bool {
+	if pos < 0 || pos+len(want) > len(lines) {
+		return false
+	}
+	for idx, l := range want {
+		if lines[pos+idx] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// context returns the number of context lines at the beginning (or, if
+// fromEnd is true, at the end) of h.
+func (h *hunk) context(fromEnd bool) int {
+	var n int
+	for idx := range h.lines {
+		l := h.lines[idx]
+		if fromEnd {
+			l = h.lines[len(h.lines)-1-idx]
+		}
+		if l.op != ' ' {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// applyHunk applies h to lines, looking for the hunk’s position starting at
+// expected, searching in both directions, but never before min. It returns the
+// modified lines and the position after the applied hunk (including context
+// lines which were ignored due to fuzz).
+func applyHunk(lines []string, h *hunk, expected, min int) ([]string, int, bool) {
+	old, new := h.side('-'), h.side('+')
+	leading, trailing := h.context(false), h.context(true)
+	for fuzz := 0; fuzz <= maxFuzz; fuzz++ {
+		top, bottom := fuzz, fuzz
+		if top > leading {
+			top = leading
+		}
+		if bottom > trailing {
+			bottom = trailing
+		}
+		if fuzz > 0 && top+bottom == 0 {
+			break // no context to ignore
+		}
+		if top+bottom > len(old) {
+			break
+		}
+		o := old[top : len(old)-bottom]
+		n := new[top : len(new)-bottom]
+		start := expected + top
+		for delta := 0; ; delta++ {
+			before, after := start-delta, start+delta
+			if before < min && after+len(o) > len(lines) {
+				break
+			}
+			for _, pos := range []int{before, after} {
+				if pos < min || !matchAt(lines, o, pos) {
+					continue
+				}
+				result := make([]string, 0, len(lines)-len(o)+len(n))
+				result = append(result, lines[:pos]...)
+				result = append(result, n...)
+				result = append(result, lines[pos+len(o):]...)
+				return result, pos + len(n) + bottom, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// patchError describes which part of a patch failed to apply.
+type patchError struct {
+	Patch string
+	File  string
+	Hunk  int // 1-based, 0 if the error is not specific to a hunk
+	Err   error
+}
+
+func (e *patchError) Error() string {
+	if e.Hunk > 0 {
+		return fmt.Sprintf("patch %s: %s: hunk #%d: %v", e.Patch, e.File, e.Hunk, e.Err)
+	}
+	if e.File != "" {
+		return fmt.Sprintf("patch %s: %s: %v", e.Patch, e.File, e.Err)
+	}
+	return fmt.Sprintf("patch %s: %v", e.Patch, e.Err)
+}
+
+// overlayFile is the state of a file after applying patches in memory.
+type overlayFile struct {
+	lines   []string
+	mode    os.FileMode
+	deleted bool
+}
+
+// overlay records modifications to the package tree in dir, which are only
+// written once the entire patch series applied.
+type overlay struct {
+	dir   string
+	files map[string]*overlayFile // keyed by path relative to dir
+}
+
+func (o *overlay) get(name string) (*overlayFile, error) {
+	if f, ok := o.files[name]; ok {
+		return f, nil
+	}
+	fi, err := os.Stat(filepath.Join(o.dir, name))
 	if err != nil {
-		return err
+		if os.IsNotExist(err) {
+			return &overlayFile{mode: 0644, deleted: true}, nil
+		}
+		return nil, err
 	}
-	patches, err := ioutil.ReadFile(filepath.Join(patchDir, "series"))
+	b, err := ioutil.ReadFile(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &overlayFile{lines: fileLines(b), mode: fi.Mode().Perm()}, nil
+}
+
+// creates reports whether fd creates a file, either explicitly (/dev/null) or
+// implicitly (diff -N, with only a hunk starting at line 0).
+func (fd *fileDiff) creates(oldName string) bool {
+	if oldName == "/dev/null" {
+		return true
+	}
+	return len(fd.hunks) == 1 && fd.hunks[0].oldStart == 0 && fd.hunks[0].oldLines == 0
+}
+
+// deletes is like creates, but for file deletion.
+func (fd *fileDiff) deletes(newName string) bool {
+	if newName == "/dev/null" {
+		return true
+	}
+	return len(fd.hunks) == 1 && fd.hunks[0].newStart == 0 && fd.hunks[0].newLines == 0
+}
+
+func (o *overlay) applyDiff(fd *fileDiff, e seriesEntry) error {
+	pe := &patchError{Patch: e.Patch}
+	oldName, newName := fd.oldName, fd.newName
+	if e.Reverse {
+		oldName, newName = newName, oldName
+		for _, h := range fd.hunks {
+			h.reverse()
+		}
+	}
+	creates, deletes := fd.creates(oldName), fd.deletes(newName)
+	if oldName == "/dev/null" {
+		oldName = newName
+	}
+	if newName == "/dev/null" {
+		newName = oldName
+	}
+	source, err := stripPath(oldName, e.Strip)
+	if err != nil {
+		pe.Err = err
+		return pe
+	}
+	target, err := stripPath(newName, e.Strip)
+	if err != nil {
+		pe.Err = err
+		return pe
+	}
+	pe.File = target
+
+	f, err := o.get(source)
+	if err != nil {
+		pe.Err = err
+		return pe
+	}
+	if f.deleted && !creates {
+		pe.Err = fmt.Errorf("file not found")
+		return pe
+	}
+	if !f.deleted && creates && len(f.lines) > 0 {
+		pe.Err = fmt.Errorf("file to be created already exists")
+		return pe
+	}
+
+	lines := f.lines
+	var shift, min int
+	for idx, h := range fd.hunks {
+		expected := h.oldStart - 1 + shift
+		if h.oldLines == 0 {
+			expected = h.oldStart + shift // insertion after line oldStart
+		}
+		result, end, ok := applyHunk(lines, h, expected, min)
+		if !ok {
+			pe.Hunk = idx + 1
+			pe.Err = fmt.Errorf("@@ -%d,%d +%d,%d @@ does not apply", h.oldStart, h.oldLines, h.newStart, h.newLines)
+			return pe
+		}
+		// shift is the difference between the original position of the
+		// lines following this hunk and their current position, i.e. it
+		// includes lines added/removed by and offsets of previous hunks.
+		shift = end - (expected - shift + h.oldLines)
+		lines, min = result, end
+	}
+
+	if deletes {
+		if len(lines) > 0 {
+			pe.Err = fmt.Errorf("file to be deleted is not empty after patching")
+			return pe
+		}
+		o.files[source] = &overlayFile{deleted: true}
+		return nil
+	}
+	if source != target {
+		o.files[source] = &overlayFile{deleted: true}
+	}
+	o.files[target] = &overlayFile{lines: lines, mode: f.mode}
+	return nil
+}
+
+// write writes all modifications to disk.
+func (o *overlay) write() error {
+	for name, f := range o.files {
+		fn := filepath.Join(o.dir, name)
+		if f.deleted {
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+		// Remove first: the file might be hardlinked (see -reuse).
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := ioutil.WriteFile(fn, []byte(strings.Join(f.lines, "")), f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeries reads the quilt series file of the package tree in dir. A missing
+// series file results in no entries.
+func readSeries(dir string) ([]seriesEntry, error) {
+	series, err := ioutil.ReadFile(filepath.Join(dir, "debian", "patches", "series"))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // no patches
+			return nil, nil // no patches
 		}
-		return err
+		return nil, err
+	}
+	entries, err := parseSeries(series)
+	if err != nil {
+		return nil, &patchError{Patch: "series", Err: err}
+	}
+	return entries, nil
+}
+
+// seriesPatches returns the names of the patches in the series file of the
+// package tree in dir.
+func seriesPatches(dir string) ([]string, error) {
+	entries, err := readSeries(dir)
+	if err != nil {
+		return nil, err
 	}
-	// validate series file (otherwise quilt exits with an error)
-	hasPatches := false
-	for _, patch := range strings.Split(strings.TrimSpace(string(patches)), "\n") {
-		if strings.HasPrefix(patch, "#") {
-			continue // skip comments
+	var patches []string
+	for _, e := range entries {
+		patches = append(patches, e.Patch)
+	}
+	return patches, nil
+}
+
+// applyPatches applies the quilt patch series of the package tree in dir (see
+// debian/patches/series) and returns the names of the applied patches.
+// Patches are applied in memory and only written once the entire series
+// applied, so that dir is left untouched on error. Errors are of type
+// *patchError.
+func applyPatches(dir string) ([]string, error) {
+	entries, err := readSeries(dir)
+	if err != nil {
+		return nil, err
+	}
+	patchDir := filepath.Join(dir, "debian", "patches")
+	o := &overlay{dir: dir, files: make(map[string]*overlayFile)}
+	var applied []string
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(patchDir, filepath.FromSlash(e.Patch)))
+		if err != nil {
+			return nil, &patchError{Patch: e.Patch, Err: err}
 		}
-		if patch == "" {
-			continue // skip empty lines
+		diffs, err := parsePatch(b)
+		if err != nil {
+			return nil, &patchError{Patch: e.Patch, Err: err}
+		}
+		for _, fd := range diffs {
+			if err := o.applyDiff(fd, e); err != nil {
+				return nil, err
+			}
 		}
-		hasPatches = true
-		break
+		applied = append(applied, e.Patch)
 	}
-	if !hasPatches {
-		return nil // series file contains no valid patches
+	if err := o.write(); err != nil {
+		return nil, err
 	}
-	quilt := exec.Command("quilt", "push", "-a")
-	quilt.Stderr = os.Stderr
-	quilt.Dir = dir
-	quilt.Env = []string{"QUILT_PATCHES=" + patchDir}
-	if err := quilt.Run(); err != nil {
-		return fmt.Errorf("%v in %v: %v", quilt.Args, quilt.Dir, err)
+	return applied, nil
+}
+
+// applyDiffGz applies the gzip-compressed diff of a 1.0 source package in fn
+// (named name in errors) to the package tree in dir, like dpkg-source -x does.
+// Errors applying the diff are of type *patchError.
+func applyDiffGz(dir, fn, name string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	diffs, err := parsePatch(b)
+	if err != nil {
+		return &patchError{Patch: name, Err: err}
+	}
+	// The diff compares <pkg>-<version>.orig/ with <pkg>-<version>/:
+	e := seriesEntry{Patch: name, Strip: 1}
+	o := &overlay{dir: dir, files: make(map[string]*overlayFile)}
+	for _, fd := range diffs {
+		if err := o.applyDiff(fd, e); err != nil {
+			return err
+		}
+	}
+	if err := o.write(); err != nil {
+		return err
+	}
+	// Diffs cannot represent permissions, so dpkg-source makes debian/rules
+	// executable:
+	if err := os.Chmod(filepath.Join(dir, "debian", "rules"), 0755); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
+
+// patchFailures collects the source packages whose patches do not apply, see
+// -patch_report.
+var patchFailures struct {
+	sync.Mutex
+	lines []string
+}
+
+func reportPatchFailure(src *sourceIndex, err *patchError) {
+	patchFailures.Lock()
+	defer patchFailures.Unlock()
+	patchFailures.lines = append(patchFailures.lines,
+		fmt.Sprintf("src:%s (%s): %v\n", src.Package, src.Version, err))
+}
+
+// writePatchReport writes the -patch_report file, sorted by source package.
+func writePatchReport() error {
+	patchFailures.Lock()
+	defer patchFailures.Unlock()
+	sort.Strings(patchFailures.lines)
+	return ioutil.WriteFile(*patchReport, []byte(strings.Join(patchFailures.lines, "")), 0644)
+}
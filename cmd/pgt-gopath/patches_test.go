@@ -0,0 +1,328 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSeries(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		series  string
+		want    []seriesEntry
+		wantErr bool
+	}{
+		{
+			name:   "Plain",
+			series: "01-fix-build.patch\n02-skip-tests.patch\n",
+			want: []seriesEntry{
+				{Patch: "01-fix-build.patch", Strip: 1},
+				{Patch: "02-skip-tests.patch", Strip: 1},
+			},
+		},
+		{
+			name: "CommentsAndEmptyLines",
+			series: `# Forwarded upstream:
+01-fix-build.patch # see #123456
+
+
+02-issue#42.patch
+#03-disabled.patch
+`,
+			want: []seriesEntry{
+				{Patch: "01-fix-build.patch", Strip: 1},
+				{Patch: "02-issue#42.patch", Strip: 1},
+			},
+		},
+		{
+			name:   "Options",
+			series: "a.patch -p0\nb.patch -R\nc.patch -p2 -R\nsubdir/d.patch\n",
+			want: []seriesEntry{
+				{Patch: "a.patch", Strip: 0},
+				{Patch: "b.patch", Strip: 1, Reverse: true},
+				{Patch: "c.patch", Strip: 2, Reverse: true},
+				{Patch: "subdir/d.patch", Strip: 1},
+			},
+		},
+		{
+			name:    "InvalidStrip",
+			series:  "a.patch -px\n",
+			wantErr: true,
+		},
+		{
+			name:    "UnsupportedOption",
+			series:  "a.patch --fuzz=3\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSeries([]byte(tt.series))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSeries unexpectedly succeeded: %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected entries: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// alphabet is the contents of the file which most patches below modify.
+const alphabet = "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+
+// absent marks files which must not exist in TestApplyPatches.
+const absent = "<absent>"
+
+// changeE replaces line e (5) of alphabet with E.
+const changeE = `Description: capitalize e
+ DEP-3 headers and other text before the diff are ignored.
+Forwarded: not-needed
+
+--- a/alphabet.txt
++++ b/alphabet.txt
+@@ -2,7 +2,7 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+`
+
+func TestApplyPatches(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		files   map[string]string // before patching
+		series  string
+		patches map[string]string
+		want    map[string]string // after patching
+		wantErr string            // substring of the error
+	}{
+		{
+			name:    "Exact",
+			files:   map[string]string{"alphabet.txt": alphabet},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			want:    map[string]string{"alphabet.txt": "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"},
+		},
+		{
+			name:    "Offset",
+			files:   map[string]string{"alphabet.txt": "x\ny\nz\n" + alphabet},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			want:    map[string]string{"alphabet.txt": "x\ny\nz\na\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"},
+		},
+		{
+			name:    "Fuzz",
+			files:   map[string]string{"alphabet.txt": "a\nB\nc\nd\ne\nf\ng\nH\ni\nj\n"},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			want:    map[string]string{"alphabet.txt": "a\nB\nc\nd\nE\nf\ng\nH\ni\nj\n"},
+		},
+		{
+			name:    "TooMuchFuzz",
+			files:   map[string]string{"alphabet.txt": "a\nb\nc\nD\ne\nf\ng\nh\ni\nj\n"},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			wantErr: "alphabet.txt: hunk #1",
+		},
+		{
+			name:    "Rejected",
+			files:   map[string]string{"alphabet.txt": "a\nb\nc\nd\nX\nf\ng\nh\ni\nj\n"},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			wantErr: "patch change-e.patch: alphabet.txt: hunk #1: @@ -2,7 +2,7 @@ does not apply",
+		},
+		{
+			// The first patch applies, but the series as a whole does not, so
+			// the package tree must be left untouched.
+			name:   "RejectedLeavesTreeUntouched",
+			files:  map[string]string{"alphabet.txt": alphabet},
+			series: "change-e.patch\nchange-e-again.patch\n",
+			patches: map[string]string{
+				"change-e.patch":       changeE,
+				"change-e-again.patch": changeE,
+			},
+			want:    map[string]string{"alphabet.txt": alphabet},
+			wantErr: "patch change-e-again.patch",
+		},
+		{
+			name:   "MultipleHunks",
+			files:  map[string]string{"alphabet.txt": alphabet},
+			series: "two-hunks.patch\n",
+			patches: map[string]string{"two-hunks.patch": `--- a/alphabet.txt
++++ b/alphabet.txt
+@@ -1,3 +1,5 @@
+ a
++a1
++a2
+ b
+ c
+@@ -8,3 +10,3 @@
+ h
+-i
++I
+ j
+`},
+			want: map[string]string{"alphabet.txt": "a\na1\na2\nb\nc\nd\ne\nf\ng\nh\nI\nj\n"},
+		},
+		{
+			name:   "CreateAndDelete",
+			files:  map[string]string{"alphabet.txt": alphabet, "obsolete.txt": "old\n"},
+			series: "create.patch\ndelete.patch\n",
+			patches: map[string]string{
+				"create.patch": `--- /dev/null
++++ b/sub/new.txt
+@@ -0,0 +1,2 @@
++hello
++world
+`,
+				"delete.patch": `--- a/obsolete.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-old
+`,
+			},
+			want: map[string]string{
+				"alphabet.txt": alphabet,
+				"sub/new.txt":  "hello\nworld\n",
+				"obsolete.txt": absent,
+			},
+		},
+		{
+			name:    "CreateExisting",
+			files:   map[string]string{"new.txt": "already here\n"},
+			series:  "create.patch\n",
+			patches: map[string]string{"create.patch": "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+hello\n"},
+			wantErr: "file to be created already exists",
+		},
+		{
+			name:    "Reverse",
+			files:   map[string]string{"alphabet.txt": "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"},
+			series:  "change-e.patch -R\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			want:    map[string]string{"alphabet.txt": alphabet},
+		},
+		{
+			name:   "ReverseCreate",
+			files:  map[string]string{"alphabet.txt": alphabet, "new.txt": "hello\n"},
+			series: "create.patch -R\n",
+			patches: map[string]string{
+				"create.patch": "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+hello\n",
+			},
+			want: map[string]string{"alphabet.txt": alphabet, "new.txt": absent},
+		},
+		{
+			name:   "Strip0",
+			files:  map[string]string{"alphabet.txt": alphabet},
+			series: "p0.patch -p0\n",
+			patches: map[string]string{
+				"p0.patch": strings.Replace(strings.Replace(changeE, "a/alphabet.txt", "alphabet.txt", 1), "b/alphabet.txt", "alphabet.txt", 1),
+			},
+			want: map[string]string{"alphabet.txt": "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"},
+		},
+		{
+			name:   "Strip2",
+			files:  map[string]string{"alphabet.txt": alphabet},
+			series: "# comment\np2.patch -p2 # trailing comment\n",
+			patches: map[string]string{
+				"p2.patch": strings.Replace(strings.Replace(changeE, "a/alphabet.txt", "foo-1.0.orig/x/alphabet.txt", 1), "b/alphabet.txt", "foo-1.0/x/alphabet.txt", 1),
+			},
+			want: map[string]string{"alphabet.txt": "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"},
+		},
+		{
+			name:    "Escape",
+			files:   map[string]string{"alphabet.txt": alphabet},
+			series:  "escape.patch\n",
+			patches: map[string]string{"escape.patch": "--- /dev/null\n+++ b/../../evil.txt\n@@ -0,0 +1 @@\n+evil\n"},
+			wantErr: "escapes the package tree",
+		},
+		{
+			name:    "MissingFile",
+			files:   map[string]string{},
+			series:  "change-e.patch\n",
+			patches: map[string]string{"change-e.patch": changeE},
+			wantErr: "file not found",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write := func(name, contents string) {
+				fn := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, contents := range tt.files {
+				write(name, contents)
+			}
+			write("debian/patches/series", tt.series)
+			for name, contents := range tt.patches {
+				write("debian/patches/"+name, contents)
+			}
+
+			_, err := applyPatches(dir)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("applyPatches unexpectedly succeeded")
+				}
+				if _, ok := err.(*patchError); !ok {
+					t.Errorf("unexpected error type %T, want *patchError", err)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("unexpected error: got %q, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range tt.want {
+				b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+				got := string(b)
+				if os.IsNotExist(err) {
+					got = absent
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPatchesReturnsSeries(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "debian", "patches"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "alphabet.txt"), []byte(alphabet), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "debian", "patches", "series"), []byte("# none yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	patches, err := applyPatches(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 0 {
+		t.Errorf("unexpected patches: %q", patches)
+	}
+}
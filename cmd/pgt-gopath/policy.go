@@ -0,0 +1,151 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+var policyPath = flag.String("policy",
+	"",
+	"Path of a JSON file listing ignored source packages and Go-Import-Path rewrites, in the format of policy.json in the pgt-gopath source. Defaults to the policy.json compiled into pgt-gopath.")
+
+//go:embed policy.json
+var defaultPolicy []byte
+
+// policyVersion is the version of the policy file format.
+const policyVersion = 1
+
+// policyEntry documents why a source package is special-cased. Each entry
+// should be removed once the bug is fixed.
+type policyEntry struct {
+	Reason  string `json:"reason"`
+	Bug     string `json:"bug,omitempty"`     // e.g. https://bugs.debian.org/890056
+	Expires string `json:"expires,omitempty"` // YYYY-MM-DD, after which the entry no longer applies
+
+	expired bool
+}
+
+type rewriteEntry struct {
+	ImportPath string `json:"import_path"`
+	policyEntry
+}
+
+// policy is the contents of a policy file.
+type policy struct {
+	Version int                      `json:"version"`
+	Ignored map[string]*policyEntry  `json:"ignored"` // keyed by source package
+	Rewrite map[string]*rewriteEntry `json:"rewrite"` // keyed by source package
+}
+
+// ignored contains the source packages which are not part of the workspace.
+var ignored map[string]bool
+
+// rewrite maps from Debian source package to Go-Import-Path, for packages whose
+// Go-Import-Path is missing or wrong.
+var rewrite map[string]string
+
+func (e *policyEntry) see() string {
+	if e.Bug == "" {
+		return ""
+	}
+	return " (see " + e.Bug + ")"
+}
+
+func (e *policyEntry) check(kind, pkg string, now time.Time) error {
+	if e.Reason == "" {
+		return fmt.Errorf("%s entry for src:%s: reason missing", kind, pkg)
+	}
+	if e.Expires == "" {
+		return nil
+	}
+	expires, err := time.Parse("2006-01-02", e.Expires)
+	if err != nil {
+		return fmt.Errorf("%s entry for src:%s: %v", kind, pkg, err)
+	}
+	if now.After(expires) {
+		e.expired = true
+		log.Printf("WARNING: policy: %s entry for src:%s expired on %s, no longer applying it%s", kind, pkg, e.Expires, e.see())
+	}
+	return nil
+}
+
+// loadPolicy reads the policy file at path (or the default policy if path is
+// empty) and populates ignored and rewrite.
+func loadPolicy(path string) (*policy, error) {
+	b := defaultPolicy
+	if path != "" {
+		var err error
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		path = "policy.json (built in)"
+	}
+	var p policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if p.Version != policyVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d, expected %d", path, p.Version, policyVersion)
+	}
+	now := time.Now()
+	ignored = make(map[string]bool, len(p.Ignored))
+	for pkg, e := range p.Ignored {
+		if err := e.check("ignored", pkg, now); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if !e.expired {
+			ignored[pkg] = true
+		}
+	}
+	rewrite = make(map[string]string, len(p.Rewrite))
+	for pkg, e := range p.Rewrite {
+		if e.ImportPath == "" {
+			return nil, fmt.Errorf("%s: rewrite entry for src:%s: import_path missing", path, pkg)
+		}
+		if err := e.check("rewrite", pkg, now); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if !e.expired {
+			rewrite[pkg] = e.ImportPath
+		}
+	}
+	return &p, nil
+}
+
+// warnStale logs policy entries which are no longer needed: rewrites whose
+// import path is declared by the archive’s Go-Import-Path by now, and entries
+// for source packages which are not in srcs (anymore).
+func (p *policy) warnStale(srcs []sourceIndex) {
+	byName := make(map[string]*sourceIndex, len(srcs))
+	for idx := range srcs {
+		byName[srcs[idx].Package] = &srcs[idx]
+	}
+	for pkg, e := range p.Ignored {
+		if _, ok := byName[pkg]; !ok && !e.expired {
+			log.Printf("policy: ignored src:%s no longer exists, the entry can be removed%s", pkg, e.see())
+		}
+	}
+	for pkg, e := range p.Rewrite {
+		if e.expired {
+			continue
+		}
+		src, ok := byName[pkg]
+		if !ok {
+			log.Printf("policy: rewritten src:%s no longer exists, the entry can be removed%s", pkg, e.see())
+			continue
+		}
+		for _, importPath := range strings.Split(src.GoImportPath, ",") {
+			if strings.TrimSpace(importPath) == e.ImportPath {
+				log.Printf("policy: src:%s now declares Go-Import-Path %s, the rewrite can be removed%s", pkg, e.ImportPath, e.see())
+				break
+			}
+		}
+	}
+}
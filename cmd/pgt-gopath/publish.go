@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	lockPath = flag.String("lock",
+		".pgt-gopath.lock",
+		"Path of the lock file which prevents concurrent runs within the same directory. A run which cannot acquire the lock fails immediately.")
+
+	publish = flag.Bool("publish",
+		false,
+		"Publish the new snapshot by atomically pointing the src (or goproxy, see -layout) symlink to it, then run -post_publish_hook and delete old snapshots as per -keep and -keep_younger_than")
+
+	postPublishHook = flag.String("post_publish_hook",
+		"",
+		"Shell command to run after publishing a new snapshot. Its path and timestamp are passed in the environment variables PGT_GOPATH_SNAPSHOT and PGT_GOPATH_TIMESTAMP.")
+
+	keep = flag.Int("keep",
+		1,
+		"Number of most recent snapshots to keep when publishing (the published snapshot is always kept)")
+
+	keepYoungerThan = flag.Duration("keep_younger_than",
+		0,
+		"Keep all snapshots younger than this duration (based on their timestamp) when publishing, in addition to -keep")
+)
+
+// lock acquires an exclusive lock on path. The lock is held until the returned
+// file is closed (or the process exits).
+func lock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is locked: another pgt-gopath run is in progress", path)
+		}
+		return nil, fmt.Errorf("locking %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// publishSnapshot atomically points the symlink link (e.g. src) to the snapshot
+// prefix+timestamp, like “ln -snf src-<timestamp> new_src && mv -T new_src
+// src” would, runs the post-publish hook and applies the retention policy.
+// Publishing a snapshot which is already published is a no-op.
+func publishSnapshot(link, prefix, timestamp string) error {
+	name := prefix + timestamp
+	if target, err := os.Readlink(link); err == nil && target == name {
+		return nil
+	}
+	tmp := link + ".new"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return err
+	}
+	log.Printf("published %s as %s", name, link)
+
+	if *postPublishHook != "" {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		hook := exec.Command("/bin/sh", "-c", *postPublishHook)
+		hook.Stdout = os.Stderr // stdout is reserved for the timestamp
+		hook.Stderr = os.Stderr
+		hook.Env = append(os.Environ(),
+			"PGT_GOPATH_SNAPSHOT="+abs,
+			"PGT_GOPATH_TIMESTAMP="+timestamp)
+		if err := hook.Run(); err != nil {
+			return fmt.Errorf("-post_publish_hook: %v", err)
+		}
+	}
+
+	return expireSnapshots(prefix, name)
+}
+
+// expireSnapshots deletes the snapshots with prefix which are neither among
+// the -keep most recent ones, nor younger than -keep_younger_than, nor the
+// published snapshot.
+func expireSnapshots(prefix, published string) error {
+	snaps, err := snapshots(".", prefix)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*keepYoungerThan)
+	for idx, snap := range snaps {
+		if len(snaps)-idx <= *keep ||
+			snap.Name == published ||
+			(*keepYoungerThan > 0 && snap.Timestamp.After(cutoff)) {
+			continue
+		}
+		log.Printf("deleting old snapshot %s", snap.Name)
+		if err := os.RemoveAll(snap.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// depGraph maps each source package of a workspace to the source packages it
+// imports Go packages of.
+type depGraph struct {
+	dir      string
+	realDir  string        // dir with symlinks evaluated
+	trees    []packageTree // sorted by descending import path length
+	pkgNames map[string]string
+
+	mu     sync.Mutex
+	owners map[string]string // import path → source package, cached
+
+	Deps map[string][]string // source package → source packages
+}
+
+// goImports returns the import paths imported by the .go files of the package
+// tree in dir, excluding nested package trees, testdata and vendor
+// directories.
+func goImports(dir string, tests bool) ([]string, error) {
+	fset := token.NewFileSet()
+	seen := make(map[string]bool)
+	var parseErrors int
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == dir {
+				return nil
+			}
+			switch name := info.Name(); {
+			case path == filepath.Join(dir, "debian"),
+				name == "testdata" || name == "vendor",
+				strings.HasPrefix(name, "."), strings.HasPrefix(name, "_"):
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err == nil {
+				return filepath.SkipDir // another source package
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || (!tests && strings.HasSuffix(path, "_test.go")) {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
+		if err != nil {
+			parseErrors++ // e.g. code for newer Go versions, ignore
+			return nil
+		}
+		for _, imp := range f.Imports {
+			if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+				seen[p] = true
+			}
+		}
+		return nil
+	})
+	if parseErrors > 0 {
+		log.Printf("%s: ignored %d .go files which could not be parsed", dir, parseErrors)
+	}
+	imports := make([]string, 0, len(seen))
+	for p := range seen {
+		imports = append(imports, p)
+	}
+	sort.Strings(imports)
+	return imports, err
+}
+
+// owner returns the source package providing the Go package importPath, or ""
+// if no source package of the workspace does (e.g. for the standard
+// library). Symlinks created as per debian/links are followed.
+func (g *depGraph) owner(importPath string) string {
+	g.mu.Lock()
+	if pkg, ok := g.owners[importPath]; ok {
+		g.mu.Unlock()
+		return pkg
+	}
+	g.mu.Unlock()
+
+	var pkg string
+	resolved, err := filepath.EvalSymlinks(filepath.Join(g.dir, filepath.FromSlash(importPath)))
+	if err == nil {
+		if rel, err := filepath.Rel(g.realDir, resolved); err == nil {
+			rel = filepath.ToSlash(rel)
+			for _, tree := range g.trees {
+				if rel == tree.ImportPath || strings.HasPrefix(rel, tree.ImportPath+"/") {
+					pkg = g.pkgNames[tree.ImportPath]
+					break
+				}
+			}
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.owners[importPath] = pkg
+	return pkg
+}
+
+// buildDepGraph parses the Go imports of all package trees of the workspace in
+// dir.
+func buildDepGraph(dir string, tests bool) (*depGraph, error) {
+	start := time.Now()
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	trees, err := packageTrees(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(trees, func(i, j int) bool { return len(trees[i].ImportPath) > len(trees[j].ImportPath) })
+	g := &depGraph{
+		dir:      dir,
+		realDir:  realDir,
+		trees:    trees,
+		pkgNames: make(map[string]string, len(trees)),
+		owners:   make(map[string]string),
+		Deps:     make(map[string][]string, len(trees)),
+	}
+	for _, tree := range trees {
+		pkg, _, err := changelogEntry(tree.Dir)
+		if err != nil {
+			log.Printf("%s: %v", tree.ImportPath, err)
+			pkg = tree.ImportPath
+		}
+		g.pkgNames[tree.ImportPath] = pkg
+	}
+
+	var (
+		eg        errgroup.Group
+		semaphore = make(chan struct{}, 20)
+		mu        sync.Mutex
+	)
+	for _, tree := range trees {
+		tree := tree // copy
+		eg.Go(func() error {
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			imports, err := goImports(tree.Dir, tests)
+			if err != nil {
+				return err
+			}
+			pkg := g.pkgNames[tree.ImportPath]
+			deps := make(map[string]bool)
+			for _, imp := range imports {
+				if dep := g.owner(imp); dep != "" && dep != pkg {
+					deps[dep] = true
+				}
+			}
+			sorted := make([]string, 0, len(deps))
+			for dep := range deps {
+				sorted = append(sorted, dep)
+			}
+			sort.Strings(sorted)
+			mu.Lock()
+			defer mu.Unlock()
+			g.Deps[pkg] = append(sorted, g.Deps[pkg]...)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	log.Printf("parsed imports of %d source packages in %v", len(trees), time.Since(start))
+	return g, nil
+}
+
+// reverseDeps returns the source packages which directly depend on pkg, and
+// those which only transitively depend on pkg.
+func (g *depGraph) reverseDeps(pkg string) (direct, transitive []string) {
+	rdeps := make(map[string][]string)
+	for p, deps := range g.Deps {
+		for _, dep := range deps {
+			rdeps[dep] = append(rdeps[dep], p)
+		}
+	}
+	seen := map[string]bool{pkg: true}
+	queue := []string{pkg}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, rdep := range rdeps[cur] {
+			if seen[rdep] {
+				continue
+			}
+			seen[rdep] = true
+			queue = append(queue, rdep)
+			if cur == pkg {
+				direct = append(direct, rdep)
+			} else {
+				transitive = append(transitive, rdep)
+			}
+		}
+	}
+	sort.Strings(direct)
+	sort.Strings(transitive)
+	return direct, transitive
+}
+
+// writeDOT writes the graph in the Graphviz DOT language.
+func (g *depGraph) writeDOT(w io.Writer) error {
+	pkgs := make([]string, 0, len(g.Deps))
+	for pkg := range g.Deps {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	fmt.Fprintf(w, "digraph deps {\n")
+	for _, pkg := range pkgs {
+		fmt.Fprintf(w, "\t%q;\n", pkg)
+		for _, dep := range g.Deps[pkg] {
+			fmt.Fprintf(w, "\t%q -> %q;\n", pkg, dep)
+		}
+	}
+	_, err := fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// rdeps implements the rdeps subcommand, which prints the source packages of
+// the workspace that (transitively) import an import path, or exports the
+// entire dependency graph.
+func rdeps(args []string) error {
+	fset := flag.NewFlagSet("rdeps", flag.ExitOnError)
+	var (
+		dir = fset.String("dir",
+			"src",
+			"Workspace src directory (e.g. src-<timestamp>) to parse")
+
+		format = fset.String("format",
+			"text",
+			"Output format: text or json. Without import path, the whole graph is exported as dot (Graphviz) or json.")
+
+		tests = fset.Bool("tests",
+			true,
+			"Whether to consider imports of _test.go files")
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pgt-gopath rdeps [flags] [<import path or source package>]\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	g, err := buildDepGraph(*dir, *tests)
+	if err != nil {
+		return err
+	}
+
+	if fset.NArg() == 0 {
+		switch *format {
+		case "dot", "text":
+			return g.writeDOT(os.Stdout)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(g.Deps)
+		default:
+			return fmt.Errorf("unknown -format %q: expected dot or json", *format)
+		}
+	}
+
+	arg := fset.Arg(0)
+	pkg := arg
+	if _, ok := g.Deps[arg]; !ok {
+		if pkg = g.owner(arg); pkg == "" {
+			return fmt.Errorf("%s is neither a source package nor provided by one in %s", arg, *dir)
+		}
+	}
+	direct, transitive := g.reverseDeps(pkg)
+	switch *format {
+	case "text":
+		fmt.Printf("src:%s is imported directly by %d source packages:\n", pkg, len(direct))
+		for _, p := range direct {
+			fmt.Printf("\t%s\n", p)
+		}
+		fmt.Printf("and transitively by %d more:\n", len(transitive))
+		for _, p := range transitive {
+			fmt.Printf("\t%s\n", p)
+		}
+		return nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Package    string   `json:"package"`
+			Direct     []string `json:"direct"`
+			Transitive []string `json:"transitive"`
+		}{pkg, nonNil(direct), nonNil(transitive)})
+	default:
+		return fmt.Errorf("unknown -format %q: expected text or json", *format)
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
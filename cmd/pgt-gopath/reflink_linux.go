@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates newname as a copy-on-write clone of oldname (FICLONE).
+func reflink(oldname, newname string) error {
+	src, err := os.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dest, err := os.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(dest.Fd()), int(src.Fd())); err != nil {
+		dest.Close()
+		os.Remove(newname)
+		return &os.LinkError{Op: "reflink", Old: oldname, New: newname, Err: err}
+	}
+	return dest.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(oldname, newname string) error {
+	return &os.LinkError{Op: "reflink", Old: oldname, New: newname, Err: errors.New("not supported on this platform")}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"pault.ag/go/archive"
+	"pault.ag/go/debian/control"
+)
+
+var (
+	keyringPath = flag.String("keyring",
+		"",
+		"Path to an OpenPGP keyring (binary or ASCII-armored) to verify the Release files of -debian_mirror against, e.g. for Debian derivatives, local mirrors or test fixtures. Defaults to the Debian archive keyring. Cannot be combined with -insecure_skip_verify.")
+
+	insecureSkipVerify = flag.Bool("insecure_skip_verify",
+		false,
+		"Do not verify the signatures of Release files. Only the hashes of the downloaded files are verified (against the unverified Release files). Use only on systems missing the Debian archive keyring, never in production.")
+)
+
+// loadKeyring reads the OpenPGP keyring at path.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("%s: keyring contains no keys", path)
+	}
+	return keyring, nil
+}
+
+// suiteRelease is the release metadata of a suite, and the means to download
+// the index files it lists.
+type suiteRelease struct {
+	suite        string
+	release      *archive.Release
+	lastModified time.Time
+	verified     bool // false with -insecure_skip_verify
+
+	// tempFile downloads the (uncompressed) index file described by fh,
+	// relative to the suite’s directory, e.g. main/source/Sources.gz.
+	tempFile func(fh control.FileHash) (*os.File, error)
+}
+
+// fetchRelease fetches and verifies the release metadata of suite, or only
+// fetches it with -insecure_skip_verify.
+func fetchRelease(g *archive.Downloader, suite string) (*suiteRelease, error) {
+	if *insecureSkipVerify {
+		return fetchReleaseInsecure(g, suite)
+	}
+	release, rd, err := g.Release(suite)
+	if err != nil {
+		return nil, err
+	}
+	return &suiteRelease{
+		suite:        suite,
+		release:      release,
+		lastModified: rd.LastModified,
+		verified:     true,
+		tempFile:     rd.TempFile,
+	}, nil
+}
+
+// releaseDateFormats are the formats of the Date field of Release files seen in
+// the wild.
+var releaseDateFormats = []string{
+	time.RFC1123,  // e.g. Sat, 17 Oct 2026 20:14:55 UTC
+	time.RFC1123Z, // e.g. Sat, 17 Oct 2026 20:14:55 +0000
+}
+
+func parseReleaseDate(date string) (time.Time, error) {
+	var err error
+	for _, format := range releaseDateFormats {
+		var t time.Time
+		if t, err = time.Parse(format, date); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// fetchReleaseInsecure fetches the InRelease file of suite without verifying
+// its signature. Mirrors which do not send a Last-Modified header (e.g. file
+// servers of test fixtures) are supported by using the Release file’s Date
+// field instead.
+func fetchReleaseInsecure(g *archive.Downloader, suite string) (*suiteRelease, error) {
+	log.Printf("WARNING: -insecure_skip_verify: NOT verifying the signature of the %s Release file!", suite)
+	dir := path.Join("dists", suite)
+	resp, err := http.Get(g.Mirror + "/" + dir + "/InRelease")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("%s: unexpected HTTP status code: got %d, want %d", resp.Request.URL, got, want)
+	}
+	release, err := archive.LoadInRelease(resp.Body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", resp.Request.URL, err)
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		var derr error
+		if lastModified, derr = parseReleaseDate(release.Date); derr != nil {
+			return nil, fmt.Errorf("%s: neither Last-Modified (%v) nor Date (%v) are usable", resp.Request.URL, err, derr)
+		}
+	}
+	return &suiteRelease{
+		suite:        suite,
+		release:      release,
+		lastModified: lastModified,
+		tempFile: func(fh control.FileHash) (*os.File, error) {
+			fh.Filename = path.Join(dir, fh.Filename)
+			f, err := g.TempFile(fh) // verifies fh.Hash
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasSuffix(fh.Filename, ".gz") {
+				return f, nil
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return gunzipTempFile(f)
+		},
+	}, nil
+}
+
+// gunzipTempFile decompresses r into a temporary file.
+func gunzipTempFile(r io.Reader) (*os.File, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "pgt-gopath-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, gr); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
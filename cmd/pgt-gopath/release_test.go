@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"pault.ag/go/archive"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKey      *openpgp.Entity // signs the fixture mirror
+	otherKey     *openpgp.Entity // not in the keyring
+)
+
+func testKeys(t *testing.T) (*openpgp.Entity, *openpgp.Entity) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		var err error
+		if testKey, err = openpgp.NewEntity("pgt-gopath test", "", "test@example.net", nil); err != nil {
+			t.Fatal(err)
+		}
+		if otherKey, err = openpgp.NewEntity("pgt-gopath other", "", "other@example.net", nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return testKey, otherKey
+}
+
+// writeKeyring writes the public key of e to a keyring file, ASCII-armored
+// if armored is true.
+func writeKeyring(t *testing.T, e *openpgp.Entity, armored bool) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if armored {
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := e.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "keyring.gpg")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func clearsigned(t *testing.T, e *openpgp.Entity, plaintext string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, e.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fixtureSources contains no Go packages, so that a snapshot of the fixture
+// mirror can be created without downloading any source packages.
+const fixtureSources = `Package: hello
+Binary: hello
+Version: 2.10-2
+Maintainer: Santiago Vila <sanvila@debian.org>
+Build-Depends: debhelper-compat (= 12)
+Architecture: any
+Format: 3.0 (quilt)
+Directory: pool/main/h/hello
+`
+
+const fixtureDate = "Sat, 17 Oct 2026 20:14:55 UTC"
+
+type fixtureMirror struct {
+	*httptest.Server
+	lastModified string // Last-Modified header of InRelease, if non-empty
+	files        map[string][]byte
+}
+
+// newFixtureMirror serves a mirror with suite unstable, whose InRelease file is
+// signed by signer. If tamper is true, InRelease is modified after signing.
+func newFixtureMirror(t *testing.T, signer *openpgp.Entity, tamper bool) *fixtureMirror {
+	t.Helper()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(fixtureSources))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(gz.Bytes())
+	release := fmt.Sprintf(`Origin: Debian
+Label: Debian
+Suite: unstable
+Codename: sid
+Date: %s
+Architectures: amd64
+Components: main
+SHA256:
+ %x %d main/source/Sources.gz
+`, fixtureDate, sum, gz.Len())
+	inRelease := clearsigned(t, signer, release)
+	if tamper {
+		inRelease = bytes.Replace(inRelease, []byte("Label: Debian"), []byte("Label: Evil"), 1)
+	}
+	m := &fixtureMirror{
+		lastModified: "Sat, 17 Oct 2026 20:20:00 GMT",
+		files: map[string][]byte{
+			"/dists/unstable/InRelease":              inRelease,
+			"/dists/unstable/main/source/Sources.gz": gz.Bytes(),
+		},
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := m.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/InRelease") && m.lastModified != "" {
+			w.Header().Set("Last-Modified", m.lastModified)
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// setFlag sets the string flag *p to val for the duration of the test.
+func setFlag(t *testing.T, p *string, val string) {
+	old := *p
+	*p = val
+	t.Cleanup(func() { *p = old })
+}
+
+// setInsecure sets -insecure_skip_verify for the duration of the test.
+func setInsecure(t *testing.T) {
+	old := *insecureSkipVerify
+	*insecureSkipVerify = true
+	t.Cleanup(func() { *insecureSkipVerify = old })
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key, _ := testKeys(t)
+	for _, armored := range []bool{false, true} {
+		keyring, err := loadKeyring(writeKeyring(t, key, armored))
+		if err != nil {
+			t.Fatalf("armored=%v: %v", armored, err)
+		}
+		if got, want := len(keyring), 1; got != want {
+			t.Errorf("armored=%v: unexpected number of keys: got %d, want %d", armored, got, want)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.gpg")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyring(empty); err == nil {
+		t.Errorf("loadKeyring(%s) unexpectedly succeeded", empty)
+	}
+}
+
+func TestFetchReleaseVerified(t *testing.T) {
+	key, _ := testKeys(t)
+	mirror := newFixtureMirror(t, key, false)
+	keyring, err := loadKeyring(writeKeyring(t, key, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &archive.Downloader{Mirror: mirror.URL, Keyring: keyring}
+	r, err := fetchRelease(g, "unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.verified {
+		t.Errorf("release unexpectedly not marked as verified")
+	}
+	if len(r.release.Indices()["main/source/Sources.gz"]) == 0 {
+		t.Errorf("main/source/Sources.gz not found in release indices")
+	}
+	want, _ := http.ParseTime(mirror.lastModified)
+	if !r.lastModified.Equal(want) {
+		t.Errorf("unexpected lastModified: got %v, want %v", r.lastModified, want)
+	}
+}
+
+func TestFetchReleaseBadSignature(t *testing.T) {
+	key, other := testKeys(t)
+	keyring, err := loadKeyring(writeKeyring(t, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		signer *openpgp.Entity
+		tamper bool
+	}{
+		{name: "Tampered", signer: key, tamper: true},
+		{name: "UnknownKey", signer: other},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror := newFixtureMirror(t, tt.signer, tt.tamper)
+			g := &archive.Downloader{Mirror: mirror.URL, Keyring: keyring}
+			if _, err := fetchRelease(g, "unstable"); err == nil {
+				t.Errorf("fetchRelease unexpectedly succeeded")
+			}
+		})
+	}
+}
+
+func TestFetchReleaseInsecure(t *testing.T) {
+	setInsecure(t)
+	_, other := testKeys(t)
+	mirror := newFixtureMirror(t, other, true) // would not verify
+	mirror.lastModified = ""                   // falls back to Date
+	g := &archive.Downloader{Mirror: mirror.URL}
+	r, err := fetchRelease(g, "unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.verified {
+		t.Errorf("release unexpectedly marked as verified")
+	}
+	want, err := time.Parse(time.RFC1123, fixtureDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.lastModified.Equal(want) {
+		t.Errorf("unexpected lastModified: got %v, want %v (Date)", r.lastModified, want)
+	}
+	fhs := r.release.Indices()["main/source/Sources.gz"]
+	if len(fhs) == 0 {
+		t.Fatalf("main/source/Sources.gz not found in release indices")
+	}
+	f, err := r.tempFile(fhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != fixtureSources {
+		t.Errorf("unexpected Sources contents: got %q, want %q", got, fixtureSources)
+	}
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	for _, date := range []string{
+		"Sat, 17 Oct 2026 20:14:55 UTC",
+		"Sat, 17 Oct 2026 20:14:55 +0000",
+	} {
+		got, err := parseReleaseDate(date)
+		if err != nil {
+			t.Errorf("parseReleaseDate(%q): %v", date, err)
+			continue
+		}
+		if want := time.Date(2026, 10, 17, 20, 14, 55, 0, time.UTC); !got.Equal(want) {
+			t.Errorf("parseReleaseDate(%q) = %v, want %v", date, got, want)
+		}
+	}
+	if _, err := parseReleaseDate("yesterday"); err == nil {
+		t.Errorf("parseReleaseDate(yesterday) unexpectedly succeeded")
+	}
+}
+
+// snapshotManifest creates a snapshot of mirror in a temporary directory and
+// returns its manifest.
+func snapshotManifest(t *testing.T, mirror *fixtureMirror) (*manifest, error) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	setFlag(t, debianMirror, mirror.URL)
+	setFlag(t, suites, "unstable")
+	setFlag(t, components, "main")
+
+	if err := logic(); err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "src-*", "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected exactly one snapshot manifest, found %q", matches)
+	}
+	b, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return &m, nil
+}
+
+func TestManifestVerified(t *testing.T) {
+	key, _ := testKeys(t)
+	setFlag(t, keyringPath, writeKeyring(t, key, true))
+	m, err := snapshotManifest(t, newFixtureMirror(t, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []suiteVerification{{Suite: "unstable", Verified: true}}
+	if !reflect.DeepEqual(m.Verification, want) {
+		t.Errorf("manifest: verification = %+v, want %+v", m.Verification, want)
+	}
+}
+
+func TestManifestBadSignature(t *testing.T) {
+	key, _ := testKeys(t)
+	setFlag(t, keyringPath, writeKeyring(t, key, true))
+	if _, err := snapshotManifest(t, newFixtureMirror(t, key, true)); err == nil {
+		t.Errorf("creating a snapshot of a mirror with a bad signature unexpectedly succeeded")
+	}
+}
+
+func TestManifestInsecureSkipVerify(t *testing.T) {
+	setInsecure(t)
+	key, _ := testKeys(t)
+	mirror := newFixtureMirror(t, key, true)
+	mirror.lastModified = ""
+	m, err := snapshotManifest(t, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verification := []suiteVerification{{Suite: "unstable", Verified: false}}
+	if !reflect.DeepEqual(m.Verification, verification) {
+		t.Errorf("manifest: verification = %+v, want %+v", m.Verification, verification)
+	}
+	want, _ := time.Parse(time.RFC1123, fixtureDate)
+	if !m.Timestamp.Equal(want) {
+		t.Errorf("manifest: timestamp = %v, want %v (Date)", m.Timestamp, want)
+	}
+}
+
+func TestKeyringInsecureSkipVerify(t *testing.T) {
+	setInsecure(t)
+	key, _ := testKeys(t)
+	setFlag(t, keyringPath, writeKeyring(t, key, true))
+	if _, err := snapshotManifest(t, newFixtureMirror(t, key, false)); err == nil {
+		t.Errorf("-keyring with -insecure_skip_verify unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// proxyIndex maps module paths to the modules of one snapshot.
+type proxyIndex struct {
+	snapshot snapshot
+	modules  map[string]*goModule
+}
+
+func newProxyIndex(snap snapshot) (*proxyIndex, error) {
+	start := time.Now()
+	trees, err := packageTrees(snap.Path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &proxyIndex{
+		snapshot: snap,
+		modules:  make(map[string]*goModule, len(trees)),
+	}
+	for _, tree := range trees {
+		pkg, v, err := changelogEntry(tree.Dir)
+		if err != nil {
+			log.Printf("%s: %v", tree.ImportPath, err)
+			continue
+		}
+		m, err := moduleForTree(tree.Dir, tree.ImportPath, v.Version)
+		if err != nil {
+			log.Printf("src:%s: not serving module: %v", pkg, err)
+			continue
+		}
+		if other, ok := idx.modules[m.Path]; ok {
+			log.Printf("src:%s: module %s already provided by %s, skipping", pkg, m.Path, other.Dir)
+			continue
+		}
+		idx.modules[m.Path] = m
+	}
+	log.Printf("indexed %d modules of %s in %v", len(idx.modules), snap.Name, time.Since(start))
+	return idx, nil
+}
+
+// goproxy implements the GOPROXY protocol (see “go help goproxy”) for the
+// latest snapshot in dir.
+type goproxy struct {
+	dir string
+
+	mu  sync.RWMutex
+	idx *proxyIndex
+}
+
+func (p *goproxy) index() *proxyIndex {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.idx
+}
+
+// update switches to the latest snapshot, if it changed. Requests which are in
+// flight continue to be served from the previous snapshot.
+func (p *goproxy) update() error {
+	snap, err := latestSnapshot(p.dir)
+	if err != nil {
+		return err
+	}
+	if cur := p.index(); cur != nil && cur.snapshot.Name == snap.Name {
+		return nil
+	}
+	idx, err := newProxyIndex(*snap)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idx = idx
+	return nil
+}
+
+// notModified handles conditional requests before expensive work (e.g.
+// creating a module zip) is done. Both validators only change when a new
+// snapshot is served.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if inm != etag {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modtime.After(ims) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func (p *goproxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "this URL requires HTTP GET", http.StatusMethodNotAllowed)
+		return
+	}
+	idx := p.index()
+	urlPath := strings.TrimPrefix(r.URL.Path, "/")
+
+	var escPath, file string
+	if strings.HasSuffix(urlPath, "/@latest") {
+		escPath, file = strings.TrimSuffix(urlPath, "/@latest"), "@latest"
+	} else if pos := strings.LastIndex(urlPath, "/@v/"); pos > -1 {
+		escPath, file = urlPath[:pos], urlPath[pos+len("/@v/"):]
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	mp, err := module.UnescapePath(escPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, ok := idx.modules[mp]
+	if !ok {
+		// 404 makes the go tool fall back to the next entry in GOPROXY.
+		http.Error(w, fmt.Sprintf("module %s not found in %s", mp, idx.snapshot.Name), http.StatusNotFound)
+		return
+	}
+
+	modtime := idx.snapshot.Timestamp
+	etag := fmt.Sprintf(`"%d"`, modtime.Unix())
+	if file == "list" {
+		if notModified(w, r, etag, modtime) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, file, modtime, strings.NewReader(m.Version+"\n"))
+		return
+	}
+	if file == "@latest" {
+		if notModified(w, r, etag, modtime) {
+			return
+		}
+		b, err := m.info(modtime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeContent(w, r, file, modtime, bytes.NewReader(b))
+		return
+	}
+
+	ext := file[strings.LastIndex(file, ".")+1:]
+	v, err := module.UnescapeVersion(strings.TrimSuffix(file, "."+ext))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v != m.Version {
+		http.Error(w, fmt.Sprintf("module %s: version %s not found (%s contains %s)", mp, v, idx.snapshot.Name, m.Version), http.StatusNotFound)
+		return
+	}
+	if notModified(w, r, etag, modtime) {
+		return
+	}
+	var b []byte
+	switch ext {
+	case "info":
+		b, err = m.info(modtime)
+		w.Header().Set("Content-Type", "application/json")
+	case "mod":
+		b = m.GoMod
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case "zip":
+		var buf bytes.Buffer
+		err = m.writeZip(&buf)
+		b = buf.Bytes()
+		w.Header().Set("Content-Type", "application/zip")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, file, modtime, bytes.NewReader(b))
+}
+
+// serve implements the serve subcommand, which serves the latest snapshot via
+// the GOPROXY protocol, so that e.g. CI machines can use
+// GOPROXY=http://<host>:<port> GOFLAGS=-mod=mod.
+func serve(args []string) error {
+	fset := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		listen = fset.String("listen",
+			"localhost:3000",
+			"[host]:port to listen on")
+
+		dir = fset.String("dir",
+			".",
+			"Directory containing the src-<timestamp> snapshots created by pgt-gopath")
+
+		poll = fset.Duration("poll",
+			30*time.Second,
+			"How often to check for a new snapshot")
+	)
+	fset.Parse(args)
+
+	p := &goproxy{dir: *dir}
+	if err := p.update(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(*poll) {
+			if err := p.update(); err != nil {
+				log.Printf("updating snapshot: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("serving GOPROXY protocol on %s", *listen)
+	return http.ListenAndServe(*listen, p)
+}
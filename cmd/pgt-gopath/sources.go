@@ -7,7 +7,6 @@ import (
 	"sort"
 	"strings"
 
-	"pault.ag/go/archive"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/dependency"
 	"pault.ag/go/debian/version"
@@ -21,17 +20,44 @@ type sourceIndex struct {
 	BuildDepends    dependency.Dependency `control:"Build-Depends"`
 	GoImportPath    string                `control:"Go-Import-Path"`
 	ExtraSourceOnly bool                  `control:"Extra-Source-Only"`
+	Format          string
 	Package         string
 	Version         version.Version
 	Directory       string
+
+	// Suite is the suite (e.g. unstable) whose Sources index contained this
+	// source package. It is not part of the index itself.
+	Suite string
 }
 
-func (src *sourceIndex) importPath() string {
-	importPath := src.GoImportPath
+// importPaths returns all import paths declared in Go-Import-Path (or the
+// rewritten ones, see rewrite). The first one is the primary import path, i.e.
+// where the package tree is unpacked. The others are aliases (e.g. vanity
+// import paths), which are symlinked to the package tree.
+func (src *sourceIndex) importPaths() []string {
+	goImportPath := src.GoImportPath
 	if to, ok := rewrite[src.Package]; ok {
-		importPath = to
+		goImportPath = to
+	}
+	var importPaths []string
+	seen := make(map[string]bool)
+	for _, importPath := range strings.Split(goImportPath, ",") {
+		importPath = strings.TrimSpace(importPath)
+		if importPath == "" || seen[importPath] {
+			continue
+		}
+		seen[importPath] = true
+		importPaths = append(importPaths, importPath)
+	}
+	return importPaths
+}
+
+// importPath returns the primary import path, or "" if there is none.
+func (src *sourceIndex) importPath() string {
+	if importPaths := src.importPaths(); len(importPaths) > 0 {
+		return importPaths[0]
 	}
-	return strings.Split(importPath, ",")[0]
+	return ""
 }
 
 func dependsOnGo(sidx *sourceIndex) bool {
@@ -70,8 +96,29 @@ func loadSources(r io.Reader) ([]sourceIndex, error) {
 	return filtered, nil
 }
 
-func downloadSources(r *archive.ReleaseDownloader, sourcesHash control.FileHash) ([]sourceIndex, error) {
-	f, err := r.TempFile(sourcesHash)
+// mergeSources layers srcs on top of base, following apt semantics: the highest
+// version of each source package wins. On equal versions, base wins.
+func mergeSources(base, srcs []sourceIndex) []sourceIndex {
+	byName := make(map[string]int, len(base))
+	for idx, src := range base {
+		byName[src.Package] = idx
+	}
+	for _, src := range srcs {
+		idx, ok := byName[src.Package]
+		if !ok {
+			byName[src.Package] = len(base)
+			base = append(base, src)
+			continue
+		}
+		if version.Compare(src.Version, base[idx].Version) > 0 {
+			base[idx] = src
+		}
+	}
+	return base
+}
+
+func downloadSources(tempFile func(control.FileHash) (*os.File, error), sourcesHash control.FileHash) ([]sourceIndex, error) {
+	f, err := tempFile(sourcesHash)
 	if err != nil {
 		return nil, err
 	}
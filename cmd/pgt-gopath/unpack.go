@@ -1,43 +1,410 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"strconv"
+	"path"
+	"path/filepath"
 	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
+// decompress returns a reader for the tarball contained in r, which is
+// compressed with any of the compressors dpkg-source supports (or not at all).
+// The compressor is detected by its magic bytes, not by the file name.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte{0x5d, 0x00, 0x00}):
+		// The .lzma format has no magic, but xz-utils always writes these
+		// properties (lc=3, lp=0, pb=2) as first byte.
+		return lzma.NewReader(br)
+	default:
+		return br, nil
+	}
+}
+
+// within reports whether p is dir or located below dir. Both paths must be
+// clean.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// checkParents returns an error if any existing directory between dir
+// (exclusive) and p (exclusive) is a symlink, as creating p would then follow
+// the symlink, possibly to outside of dir.
+func checkParents(dir, p string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	cur := dir
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, component)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil // will be created as a directory
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("parent directory %s is a symlink", cur)
+		}
+	}
+	return nil
+}
+
+// resolvesWithin reports whether p, which is located within dir, is still
+// located within dir once all symlinks are resolved (like the kernel would).
+// Components which do not exist are resolved lexically.
+func resolvesWithin(dir, p string) (bool, error) {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false, err
+	}
+	queue := strings.Split(rel, string(filepath.Separator))
+	cur := dir
+	var followed int
+	for len(queue) > 0 {
+		component := queue[0]
+		queue = queue[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			if !within(dir, cur) {
+				return false, nil
+			}
+			continue
+		}
+		next := filepath.Join(cur, component)
+		fi, err := os.Lstat(next)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if followed++; followed > 40 {
+			// Like the kernel, give up (ELOOP): p cannot be accessed at
+			// all, let alone outside of dir.
+			return true, nil
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return false, err
+		}
+		if filepath.IsAbs(target) {
+			return false, nil
+		}
+		queue = append(strings.Split(target, "/"), queue...)
+	}
+	return within(dir, cur), nil
+}
+
+// normalizedMode returns the permissions to use for files extracted from an
+// archive: world-readable, writable only by the owner, and executable if the
+// archive marks them executable for anyone. This enables building with
+// unprivileged users (e.g. golang-github-svent-go-nbreader comes with a debian
+// tarball without world-readable bits). Permissions were copied from “apt
+// source”.
+func normalizedMode(hdr *tar.Header) os.FileMode {
+	return normalizedPerm(hdr.Typeflag == tar.TypeDir, os.FileMode(hdr.Mode))
+}
+
+// normalizedPerm is like normalizedMode, for a directory (if dir is true) or
+// file with the permissions perm.
+func normalizedPerm(dir bool, perm os.FileMode) os.FileMode {
+	if dir || perm&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// link is a symbolic or hard link, which is created only once all regular
+// files have been moved to their final location, so that link targets can be
+// verified against the destination and no file is ever written through a
+// link contained in the archive.
+type link struct {
+	name   string // slash-separated path within the archive
+	target string
+	hard   bool
+}
+
+// unpack extracts the tarball fn into dest in a single pass. If all entries are
+// placed in a common top-level directory (as they should be), its contents are
+// placed in dest. Some packages (e.g. golang-github-nwidger-jsoncolor) have
+// .orig.tar files which don’t place their files in a subdirectory, in which
+// case the tarball’s contents are placed in dest as-is.
+//
+// Entries which would end up outside of dest (e.g. ../../etc/passwd, or
+// symlinks pointing outside of dest, directly or via other symlinks) result in
+// an error.
 func unpack(dest, fn string) error {
 	if err := os.MkdirAll(dest, 0755); err != nil {
 		return err
 	}
-	// Some packages (e.g. golang-github-nwidger-jsoncolor) have .orig.tar files
-	// which don’t place their files in a subdirectory, so we need to check for
-	// that:
-	tf := exec.Command("tar", "tf", fn)
-	stripComponents := 1
-	out, err := tf.Output()
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close() // e.g. stops the zstd decoder’s goroutines
+	}
+
+	// Files are extracted into a staging directory first, as where they belong
+	// is only known once the whole tarball was read.
+	staging, err := ioutil.TempDir(dest, ".unpack-")
 	if err != nil {
 		return err
 	}
-	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
-		if !strings.Contains(line, "/") {
-			stripComponents = 0
+	defer os.RemoveAll(staging)
+
+	var (
+		links    []link
+		top      string // common top-level directory, if any
+		noCommon bool   // whether entries without common top-level directory were seen
+	)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader || hdr.Typeflag == tar.TypeXHeader {
+			// e.g. pax_global_header of git archive (and thus GitHub)
+			// tarballs, which is metadata, not a file.
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%s: entry %q escapes the destination", fn, hdr.Name)
+		}
+
+		first := name
+		if idx := strings.IndexByte(name, '/'); idx > -1 {
+			first = name[:idx]
+		} else if hdr.Typeflag != tar.TypeDir {
+			noCommon = true // file at the top-level
+		}
+		if top == "" {
+			top = first
+		} else if top != first {
+			noCommon = true
+		}
+
+		target := filepath.Join(staging, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(target, tr, normalizedMode(hdr)); err != nil {
+				return fmt.Errorf("%s: %v", fn, err)
+			}
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, link{name: name, target: hdr.Linkname})
+		case tar.TypeLink:
+			links = append(links, link{name: name, target: path.Clean(hdr.Linkname), hard: true})
+		default:
+			// Devices, FIFOs etc. have no place in a source package.
+		}
 	}
 
-	tar := exec.Command("tar",
-		"xf",
-		fn,
-		"-C", dest,
-		"--strip-components="+strconv.Itoa(stripComponents),
-	)
-	tar.Stderr = os.Stderr
-	if err := tar.Run(); err != nil {
-		return fmt.Errorf("%v: %v", tar.Args, err)
+	root := staging
+	strip := ""
+	if !noCommon && top != "" {
+		root = filepath.Join(staging, top)
+		strip = top + "/"
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil // tarball contains only links or nothing at all
+	}
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := merge(filepath.Join(root, fi.Name()), filepath.Join(dest, fi.Name())); err != nil {
+			return err
+		}
 	}
 
+	// Links are created in archive order, so a link might be placed in (or
+	// point to) a directory which an earlier link redirects: parent
+	// directories must not be symlinks, and symlinks are verified once all
+	// links exist.
+	var symlinks []link
+	for _, l := range links {
+		if !strings.HasPrefix(l.name, strip) {
+			continue // the top-level directory itself
+		}
+		newname := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(l.name, strip)))
+		if err := checkParents(dest, newname); err != nil {
+			return fmt.Errorf("%s: link %q: %v", fn, l.name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(newname), 0755); err != nil {
+			return err
+		}
+		if err := removeNonDir(newname); err != nil {
+			return err
+		}
+		if l.hard {
+			oldname := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(l.target, strip)))
+			if !strings.HasPrefix(l.target, strip) || !within(dest, oldname) {
+				return fmt.Errorf("%s: hard link %q to %q escapes the destination", fn, l.name, l.target)
+			}
+			if err := checkParents(dest, oldname); err != nil {
+				return fmt.Errorf("%s: hard link %q to %q: %v", fn, l.name, l.target, err)
+			}
+			// os.Link does not follow symlinks, so a hard link to a
+			// symlink would be a symlink relative to another directory.
+			if fi, err := os.Lstat(oldname); err == nil && !fi.Mode().IsRegular() {
+				return fmt.Errorf("%s: hard link %q to %q: not a regular file", fn, l.name, l.target)
+			}
+			if err := os.Link(oldname, newname); err != nil {
+				return err
+			}
+			continue
+		}
+		if filepath.IsAbs(l.target) || !within(dest, filepath.Join(filepath.Dir(newname), l.target)) {
+			return fmt.Errorf("%s: symlink %q to %q escapes the destination", fn, l.name, l.target)
+		}
+		if err := os.Symlink(l.target, newname); err != nil {
+			return err
+		}
+		symlinks = append(symlinks, l)
+	}
+	var escaping error
+	for _, l := range symlinks {
+		newname := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(l.name, strip)))
+		ok, err := resolvesWithin(dest, newname)
+		if err == nil && ok {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("symlink %q to %q escapes the destination", l.name, l.target)
+		}
+		if escaping == nil {
+			escaping = fmt.Errorf("%s: %v", fn, err)
+		}
+		// Remove the symlink so that the package tree can be inspected
+		// safely (see -quarantine).
+		if err := os.Remove(newname); err != nil {
+			return err
+		}
+	}
+
+	return escaping
+}
+
+func writeFile(filename string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeNonDir removes filename, unless it does not exist or is a directory.
+func removeNonDir(filename string) error {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: is a directory", filename)
+	}
+	return os.Remove(filename)
+}
+
+// merge moves src to dest. Existing directories are merged (dest might contain
+// e.g. nested package trees of other source packages), existing files and
+// symlinks are replaced, like tar(1) would.
+func merge(src, dest string) error {
+	sfi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return os.Rename(src, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if !sfi.IsDir() || !dfi.IsDir() {
+		if err := removeNonDir(dest); err != nil {
+			return err
+		}
+		return os.Rename(src, dest)
+	}
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := merge(filepath.Join(src, fi.Name()), filepath.Join(dest, fi.Name())); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test tarball. Entries whose name ends in a slash
+// are directories.
+type tarEntry struct {
+	name     string
+	body     string
+	symlink  string
+	typeflag byte // overrides the type derived from the fields above
+	pax      map[string]string
+}
+
+// writeTarball writes entries to a gzip-compressed tarball in a temporary
+// directory and returns its path.
+func writeTarball(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "test.orig.tar.gz")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:       e.name,
+			Mode:       0644,
+			Typeflag:   tar.TypeReg,
+			Size:       int64(len(e.body)),
+			PAXRecords: e.pax,
+		}
+		switch {
+		case e.typeflag != 0:
+			hdr.Typeflag = e.typeflag
+		case e.symlink != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.symlink
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// archive/tar names it itself, git archive uses pax_global_header.
+			hdr = &tar.Header{Typeflag: hdr.Typeflag, PAXRecords: hdr.PAXRecords}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// treeContents returns the files of dir (relative paths → contents, or “->
+// target” for symlinks).
+func treeContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			contents[filepath.ToSlash(rel)] = "-> " + target
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestUnpack(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tarEntry
+		want    map[string]string
+	}{
+		{
+			name: "TopLevelDirectory",
+			entries: []tarEntry{
+				{name: "foo-1.0/"},
+				{name: "foo-1.0/foo.go", body: "package foo\n"},
+				{name: "foo-1.0/internal/bar.go", body: "package bar\n"},
+			},
+			want: map[string]string{
+				"foo.go":          "package foo\n",
+				"internal/bar.go": "package bar\n",
+			},
+		},
+		{
+			// Created by git archive (and thus GitHub).
+			name: "PAXGlobalHeader",
+			entries: []tarEntry{
+				{
+					typeflag: tar.TypeXGlobalHeader,
+					pax:      map[string]string{"comment": "8f0e4bd2a1b5e9c4fd1a3f6b9d8e7c6a5b4f3e2d"},
+				},
+				{name: "foo-1.0/"},
+				{name: "foo-1.0/foo.go", body: "package foo\n"},
+			},
+			want: map[string]string{
+				"foo.go": "package foo\n",
+			},
+		},
+		{
+			name: "NoTopLevelDirectory",
+			entries: []tarEntry{
+				{name: "foo.go", body: "package foo\n"},
+				{name: "internal/bar.go", body: "package bar\n"},
+			},
+			want: map[string]string{
+				"foo.go":          "package foo\n",
+				"internal/bar.go": "package bar\n",
+			},
+		},
+		{
+			name: "Symlink",
+			entries: []tarEntry{
+				{name: "foo-1.0/foo.go", body: "package foo\n"},
+				{name: "foo-1.0/sub/foo.go", symlink: "../foo.go"},
+			},
+			want: map[string]string{
+				"foo.go":     "package foo\n",
+				"sub/foo.go": "-> ../foo.go",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			if err := unpack(dest, writeTarball(t, tt.entries)); err != nil {
+				t.Fatal(err)
+			}
+			if got := treeContents(t, dest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected contents: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnpackEscapes(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "DotDot",
+			entries: []tarEntry{
+				{name: "foo-1.0/../../evil", body: "x"},
+			},
+		},
+		{
+			name: "Symlink",
+			entries: []tarEntry{
+				{name: "foo-1.0/foo.go", body: "package foo\n"},
+				{name: "foo-1.0/etc", symlink: "../../etc"},
+			},
+		},
+		{
+			name: "ThroughSymlink",
+			entries: []tarEntry{
+				{name: "foo-1.0/foo.go", body: "package foo\n"},
+				{name: "foo-1.0/a", symlink: "."},
+				{name: "foo-1.0/a/a/x", symlink: "../.."},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			if err := unpack(dest, writeTarball(t, tt.entries)); err == nil {
+				t.Errorf("unpack unexpectedly succeeded")
+			}
+			var names []string
+			fis, err := ioutil.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+			}
+			sort.Strings(names)
+			if want := []string{"dest"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("files created outside of dest: %q", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pault.ag/go/debian/version"
+)
+
+// snapshot is a src-<timestamp> directory created by a previous run.
+type snapshot struct {
+	Name      string // e.g. src-1500000000
+	Path      string
+	Timestamp time.Time // last modified timestamp of the release metadata
+}
+
+// snapshots returns all snapshots with the specified prefix (e.g. src-) in
+// dir, oldest first.
+func snapshots(dir, prefix string) ([]snapshot, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshot
+	for _, fi := range fis {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimPrefix(fi.Name(), prefix), 10, 64)
+		if err != nil {
+			continue // e.g. src-tmp-…
+		}
+		snaps = append(snaps, snapshot{
+			Name:      fi.Name(),
+			Path:      filepath.Join(dir, fi.Name()),
+			Timestamp: time.Unix(ts, 0),
+		})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Timestamp.Before(snaps[j].Timestamp) })
+	return snaps, nil
+}
+
+// latestSnapshot returns the most recent src-<timestamp> snapshot in dir.
+func latestSnapshot(dir string) (*snapshot, error) {
+	snaps, err := snapshots(dir, "src-")
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, fmt.Errorf("no src-<timestamp> snapshot found in %s", dir)
+	}
+	return &snaps[len(snaps)-1], nil
+}
+
+// packageTree is the tree of one source package within a snapshot.
+type packageTree struct {
+	ImportPath string
+	Dir        string
+}
+
+// packageTrees returns the trees of all source packages within the snapshot
+// directory dir, identified by their debian/.hashes file (see process).
+func packageTrees(dir string) ([]packageTree, error) {
+	var trees []packageTree
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".pc" {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "debian", ".hashes")); err != nil {
+			// Import paths might end in /debian (e.g. pault.ag/go/debian),
+			// so only the packaging of package trees is skipped.
+			if info.Name() == "debian" && path != dir {
+				if _, err := os.Stat(filepath.Join(filepath.Dir(path), "debian", ".hashes")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		trees = append(trees, packageTree{
+			ImportPath: filepath.ToSlash(rel),
+			Dir:        path,
+		})
+		return nil // nested trees of other source packages are possible
+	})
+	return trees, err
+}
+
+// changelogRe matches the first line of a debian/changelog file, e.g.
+// “golang-github-foo-bar (1.0-1) unstable; urgency=medium”.
+var changelogRe = regexp.MustCompile(`^(\S+) \(([^)]+)\)`)
+
+// changelogEntry returns the source package name and version of the most
+// recent entry in the debian/changelog file of the package tree in dir.
+func changelogEntry(dir string) (string, version.Version, error) {
+	f, err := os.Open(filepath.Join(dir, "debian", "changelog"))
+	if err != nil {
+		return "", version.Version{}, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", version.Version{}, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	matches := changelogRe.FindStringSubmatch(line)
+	if matches == nil {
+		return "", version.Version{}, fmt.Errorf("%s: malformed first line %q", f.Name(), line)
+	}
+	v, err := version.Parse(matches[2])
+	if err != nil {
+		return "", version.Version{}, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	return matches[1], v, nil
+}
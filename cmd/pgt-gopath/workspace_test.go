@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPackageTrees(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{
+		"pault.ag/go/archive/debian/.hashes",
+		"pault.ag/go/debian/debian/.hashes", // import path ending in /debian
+		"pault.ag/go/debian/control/control.go",
+		"example.com/foo/debian/.hashes",
+		"example.com/foo/debian/patches/series", // packaging, not a package tree
+		"example.com/foo/v2/debian/.hashes",     // nested package tree
+		"example.com/foo/.pc/applied-patches",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(fn))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trees, err := packageTrees(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tree := range trees {
+		got = append(got, tree.ImportPath)
+	}
+	want := []string{
+		"example.com/foo",
+		"example.com/foo/v2",
+		"pault.ag/go/archive",
+		"pault.ag/go/debian",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected package trees: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+// Binary pgt-repos lists all Debian go-team repositories along with metadata
+// from their debian/control, as provided by pgt-api-server’s /v1/repos.
+//
+// Example: list all repositories lacking XS-Go-Import-Path as CSV:
+//
+//	pgt-repos -missing=go_import_path -format=csv
+//
+// Example: list all repositories with a specific uploader:
+//
+//	pgt-repos -filter=uploaders=stapelberg
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	server = flag.String("server",
+		"https://pgt-api-server.debian.net",
+		"URL of the pgt-api-server instance to query")
+
+	format = flag.String("format",
+		"json",
+		"Output format, json or csv")
+
+	missing = flag.String("missing",
+		"",
+		"Comma-separated list of fields (e.g. uploaders,go_import_path) which must be empty")
+
+	filter = flag.String("filter",
+		"",
+		"Comma-separated list of field=value pairs: only list repos whose field contains value (case-insensitive)")
+
+	refresh = flag.Bool("refresh",
+		false,
+		"Bypass the server-side cache. Requires a bearer token (see PGT_API_TOKEN) if the server has authentication configured.")
+)
+
+func logic() error {
+	v := url.Values{}
+	v.Set("format", *format)
+	if *missing != "" {
+		for _, field := range strings.Split(*missing, ",") {
+			v.Add("missing", field)
+		}
+	}
+	if *filter != "" {
+		for _, f := range strings.Split(*filter, ",") {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("malformed -filter entry %q: expected field=value", f)
+			}
+			v.Add(parts[0], parts[1])
+		}
+	}
+	if *refresh {
+		v.Set("refresh", "1")
+	}
+	u := strings.TrimSuffix(*server, "/") + "/v1/repos?" + v.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("PGT_API_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: unexpected HTTP status: %v (body: %s)", u, resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}